@@ -31,6 +31,15 @@ PATTERNS_IN = {
     'MODE': 'Mode set to %(content)s',
     'ACTION': '* %(user)s %(content)s',
 
+    # Daemon's reply to /hello
+    'HELLO': 'Daemon: %(content)s',
+
+    # Daemon was already in the channel, see Client.on_channel
+    'CHANNEL': 'Topic: %(content)s',
+
+    # Capabilities hatcogd negotiated with the server
+    'CAPS': 'Capabilities: %(content)s',
+
     # RPL_AWAY
     '301': '%(user)s is away: %(content)s',
 
@@ -142,7 +151,8 @@ def translate_in(line, callbacks, timestamp=False):
     display = pattern % obj
 
     if timestamp:
-        now = datetime.now().isoformat()
+        # Server's time if it sent one (server-time), otherwise ours
+        now = obj.get('received') or datetime.now().isoformat()
         display = now + " " + display
 
     # Call a method on 'callbacks', for additional processing
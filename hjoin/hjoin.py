@@ -4,12 +4,15 @@
 
 import os
 import sys
+import json
 import logging
 import time
 import subprocess
 import socket
 import select
 import random
+import ssl
+import ipaddress
 
 from .term import Terminal
 from .remote import Server
@@ -17,6 +20,10 @@ from .hfilter import translate_in, is_irc_command
 from . import __version__
 
 VERSION = "hatcog v{} (github.com/grahamking/hatcog)".format(__version__)
+
+# Version of the hjoin <-> hatcogd protocol we speak, and what we support
+PROTOCOL_VERSION = 1
+CLIENT_FEATURES = ["replay", "state", "caps", "channel-state"]
 DEFAULT_CONFIG = "/.hatcogrc"
 LOG_DIR = "/.hatcog/"
 
@@ -25,14 +32,25 @@ DAEMON_PORT = "8790"
 
 DAEMON_WAIT_SECS = 5
 
+# Unix socket the daemon listens on, in LOG_DIR, if daemon_listen is "unix"
+DAEMON_SOCKET = "hatcogd.sock"
+
+# Shared secret we must send the daemon first, in LOG_DIR
+DAEMON_TOKEN = "hatcogd.token"
+
+# Daemon's TLS certificate, in LOG_DIR, for a daemon_host beyond this machine
+DAEMON_CERT = "hatcogd.crt"
+
 DAEMON = "/usr/local/bin/hatcogd-{arch}"
-CMD_START_DAEMON = "start-stop-daemon --start --background --exec {daemon} -- -host={host} -port={port} --logdir {logdir}"
-CMD_STOP_DAEMON = "start-stop-daemon --stop --exec {daemon}"
+CMD_START_DAEMON = "start-stop-daemon --start --background --exec {daemon} -- -host={host} -port={port} -detach={detach} -listen={listen} --logdir {logdir}"
+CMD_STOP_DAEMON = "start-stop-daemon --stop --retry 10 --exec {daemon}"
+CMD_RELOAD_DAEMON = "start-stop-daemon --stop --signal HUP --exec {daemon}"
 
 USAGE = """
 Usage: hjoin [network.channel|-private=network.nick] [--logger]
        hjoin --list   # List the defined networks
        hjoin --stop   # Stop the daemon, disconnect from all IRC networks
+       hjoin --reload # Daemon re-reads the networks in the config file
 
 Network is one of the keys in the config file: "freenode", "oftc", etc.
 There's no # in front of the channel
@@ -77,6 +95,11 @@ def main(argv=None):
         stop_daemon()
         return 0
 
+    if arg == "--reload":
+        print("Reloading daemon config")
+        reload_daemon()
+        return 0
+
     if arg == "--list" or arg == "-l":
         conf = load_config(os.getenv("HOME"))
         print("Networks: ")
@@ -177,22 +200,61 @@ class Client(object):
         """Initialize"""
 
         sock, self.is_created = get_daemon_connection(
-                self.daemon_addr, self.daemon_port)
+                self.daemon_addr,
+                self.daemon_port,
+                self.conf)
         self.server = Server(sock)
-
-        print("Requesting connection to {}".format(self.server_addr))
-        self.server.write("/connect {}".format(self.server_addr))
+        self.server.write("/auth " + get_token(self.conf))
+        self.server.write("/hello {} {}".format(
+            PROTOCOL_VERSION, " ".join(CLIENT_FEATURES)))
+        hello = self.wait_for_hello()
+
+        if hello and self.network in (hello.get("Configured") or []):
+            # Daemon has this network in it's config, it registers itself
+            print("Requesting connection to {}".format(self.network))
+            self.server.write("/connect {}".format(self.network))
+            self.is_registered = True
+        else:
+            print("Requesting connection to {}".format(self.server_addr))
+            self.server.write("/connect {}".format(self.server_addr))
         time.sleep(2)
 
         self.start_interface()
         self.start_remote()
 
+    def wait_for_hello(self):
+        """The daemon's reply to /hello, as a dict, or None if it doesn't
+        send one within DAEMON_WAIT_SECS. Older daemons don't.
+        """
+        start_time = time.time()
+        while time.time() - start_time < DAEMON_WAIT_SECS:
+            ready, _, _ = select.select([self.server.conn], [], [], 0.1)
+            if not ready and not self.server.pending():
+                continue
+            data = self.server.receive_one()
+            if not data:
+                continue
+            try:
+                obj = json.loads(data)
+            except ValueError:
+                LOG.debug("Ignoring before hello: %s", data)
+                continue
+            if obj.get("Command") == "HELLO":
+                LOG.info("Daemon %s networks %s configured %s",
+                        obj["Content"], obj["Networks"], obj["Configured"])
+                return obj
+            LOG.debug("Ignoring before hello: %s", data)
+
+        LOG.info("No hello from daemon, it's older than us")
+        return None
+
     def start_interface(self):
         """Start UI"""
 
         self.terminal = Terminal(self.users)
         self.terminal.set_channel("{}{}".format(
             self.network, self.channel))
+        self.terminal.set_nick(self.nick)
 
     def start_remote(self):
         """Connect to remote server"""
@@ -212,6 +274,8 @@ class Client(object):
             # Private message (query). /private is not standard.
             self.is_private = True
             self.server.write("/private " + self.channel)
+            # So we show their quits and nick changes
+            self.users.add(self.channel)
 
     def register(self):
         """Register ourselves with the server"""
@@ -221,6 +285,12 @@ class Client(object):
 
         self.server.write("/nick {}".format(self.nick))
         time.sleep(1)
+
+        # Password before USER, so the daemon can use SASL during registration
+        if self.password:
+            self.server.write("/pw " + self.password)
+            time.sleep(1)
+
         self.server.write("/user {nick} 0 * {name}".format(
             nick=self.nick,
             name=self.name))
@@ -228,26 +298,24 @@ class Client(object):
 
         self.is_registered = True
 
-        if self.password:
-            self.server.write("/pw " + self.password)
-            time.sleep(1)
-
         self.on_nick({"content": self.nick, "user": ""})
 
     def run(self):
         """Main loop"""
         while 1:
 
+            # TLS may already have data select can't see
+            timeout = 0 if self.server.pending() else None
             try:
                 ready, _, _ = select.select(
-                        [sys.stdin, self.server.conn], [], [])
+                        [sys.stdin, self.server.conn], [], [], timeout)
             except:
                 # Window resize signal aborts select
                 # Curses makes the resize event a fake keypress, so read it
                 self.terminal.receive_one()
                 continue
 
-            if self.server.conn in ready:
+            if self.server.conn in ready or self.server.pending():
                 sock_data = self.server.receive_one()
                 if sock_data:
                     self.act_server(sock_data)
@@ -267,6 +335,11 @@ class Client(object):
         if msg == "/quit":
             raise StopException()
 
+        elif msg == "/leave":
+            # Part the channel even if the daemon is in detach mode
+            self.server.write(msg)
+            raise StopException()
+
         elif msg == "/url":
             url = self.terminal.get_url()
             if url:
@@ -327,6 +400,10 @@ class Client(object):
     def on_nick(self, obj):
         """A nick change, possibly our own."""
 
+        if obj.get('isreplay'):
+            # Scrollback from the daemon, our user list is already current
+            return None
+
         old_nick = obj['user']
         if old_nick and old_nick not in self.users:
             # User not in our channel
@@ -346,13 +423,20 @@ class Client(object):
         """A message. Format it nicely."""
         username = obj['user']
 
+        if obj.get('isreplay'):
+            # Scrollback from the daemon, we've already been told about it
+            self.terminal.write_msg(
+                    username, obj['content'], now=message_time(obj))
+            return -1
+
         if username != self.channel and username == obj['channel']:
             # New private message
             open_private(self.conf, self.network, username)
             self.terminal.write("[Private message from {}]".format(username))
 
         else:
-            self.terminal.write_msg(username, obj['content'])
+            self.terminal.write_msg(
+                    username, obj['content'], now=message_time(obj))
 
         self.users.mark_active(username)
         self.terminal.set_active_users(self.users.active_count())
@@ -389,6 +473,9 @@ class Client(object):
 
     def on_quit(self, obj):
         """User quit IRC - treat it the same as leaving the channel"""
+        if obj.get('isreplay'):
+            # Scrollback from the daemon, our user list is already current
+            return None
         return self.on_part(obj)
 
     def on_353(self, obj):
@@ -401,6 +488,21 @@ class Client(object):
         if self.users.count() > SENSIBLE_AMOUNT:
             return -1
 
+    def on_channel(self, obj):
+        """Daemon was already in the channel: who's here, topic and modes"""
+        for member in obj["members"] or []:
+            self.users.add(member.lstrip(obj["prefixes"]))
+        self.terminal.set_users(self.users.count())
+        self.terminal.set_active_users(self.users.active_count())
+
+        if obj["topic"]:
+            self.terminal.write("Topic: {}".format(obj["topic"]))
+        if obj["modes"]:
+            self.terminal.write("Modes: {}".format(obj["modes"]))
+        if self.users.count() <= SENSIBLE_AMOUNT:
+            self.terminal.write("Users: {}".format(" ".join(obj["members"] or [])))
+        return -1
+
     def on_002(self, obj):
         """Extract host name. The first PING will replace this"""
         host_msg = obj['content'].split(',')[0]
@@ -414,6 +516,31 @@ class Client(object):
         self.terminal.set_channel(msg)
         return -1
 
+    def on_hello(self, obj):
+        """Daemon's reply to our /hello"""
+        LOG.info("Daemon %s speaks protocol %s, features: %s",
+                obj["content"], obj["protocol"], obj["features"])
+        networks = ", ".join(obj["networks"] or []) or "none yet"
+        return "Connected to {} (networks: {})".format(obj["content"], networks)
+
+    def on_status(self, obj):
+        """Daemon's reply to /hatcog status"""
+        self.terminal.write("Daemon: {}".format(obj["content"]))
+        for net in obj["networks"] or []:
+            state = "connected" if net["IsConnected"] else "disconnected"
+            if net["IsTLS"]:
+                state += ", TLS"
+            lag = "{}ms".format(net["Lag"]) if net["Lag"] >= 0 else "unknown"
+            self.terminal.write(
+                "  {} as {}: {}, up {}s, lag {}, in {}".format(
+                    net["Network"], net["Nick"], state, net["Uptime"], lag,
+                    ", ".join(net["Channels"] or [])))
+        for client in obj["clients"] or []:
+            self.terminal.write("  Window {}: {} {} from {}".format(
+                client["Id"], client["Network"], client["Channel"],
+                client["RemoteAddr"]))
+        return -1
+
     def on_mode(self, obj):
         """Block mode messages with an empty mode"""
         if not obj['content']:
@@ -606,6 +733,16 @@ def notify(conf, obj):
             shell=True)
 
 
+def message_time(obj):
+    """Time the server sent the message, as HH:MM, if it was delayed
+    (bouncer playback, lag, daemon scrollback). None means use the current time.
+    """
+    if not obj.get('delay') and not obj.get('isreplay'):
+        return None
+    # Received is RFC3339 in local time: 2012-06-30T23:59:59+01:00
+    return obj['received'][11:16]
+
+
 def open_private(conf, network, nick):
     """Open a private chat window."""
     priv_cmd = conf["cmd_private_chat"]
@@ -616,7 +753,7 @@ def open_private(conf, network, nick):
             stderr=subprocess.STDOUT)
 
 
-def get_daemon_connection(host, port):
+def get_daemon_connection(host, port, conf):
     """Returns a tuple of a socket connection to the daemon, starting it
     if necessary, and a boolean saying whether we just started the daemon.
     """
@@ -625,12 +762,15 @@ def get_daemon_connection(host, port):
     LOG.info(msg)
 
     is_created = False
+    listen = conf.get("daemon_listen", "tcp")
+    cert = get_cert(conf)
 
     try:
-        sock = socket.create_connection((host.encode("utf8"), int(port)))
+        sock = connect_daemon(host, port, listen, cert)
     except:
         LOG.exception("Could not connect")
-        sock = start_daemon(host, port)
+        sock = start_daemon(
+                host, port, conf.get("daemon_detach", "false"), listen, cert)
         is_created = True
 
     sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
@@ -639,7 +779,65 @@ def get_daemon_connection(host, port):
     return (sock, is_created)
 
 
-def start_daemon(host, port):
+def get_token(conf):
+    """The shared secret that proves to the daemon we're allowed in.
+    daemon_token in the config file, for a daemon on another machine,
+    otherwise the daemon creates it in our log dir. A daemon on another
+    machine uses TLS, so the token isn't sent in clear text.
+    """
+    if "daemon_token" in conf:
+        return conf["daemon_token"]
+
+    filename = os.path.expanduser('~') + LOG_DIR + DAEMON_TOKEN
+    with open(filename) as token_file:
+        return token_file.read().strip()
+
+
+def get_cert(conf):
+    """The daemon's TLS certificate. daemon_cert in the config file, a
+    copy of it for a daemon on another machine, otherwise the daemon
+    creates it in our log dir.
+    """
+    if "daemon_cert" in conf:
+        return os.path.expanduser(conf["daemon_cert"])
+
+    return os.path.expanduser('~') + LOG_DIR + DAEMON_CERT
+
+
+def is_loopback(host):
+    """Can only this machine reach 'host'. The daemon uses TLS anywhere else.
+    Matches hatcogd's isLoopback.
+    """
+    if host == "localhost":
+        return True
+    try:
+        return ipaddress.ip_address(host).is_loopback
+    except ValueError:
+        return False
+
+
+def connect_daemon(host, port, listen, cert):
+    """Socket connection to a running daemon. Uses the daemon's
+    Unix socket if 'listen' is "unix", otherwise TCP, with TLS if
+    'host' is beyond this machine.
+    """
+    if listen == "unix":
+        sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+        sock.connect(os.path.expanduser('~') + LOG_DIR + DAEMON_SOCKET)
+        return sock
+
+    sock = socket.create_connection((host, int(port)))
+    if is_loopback(host):
+        return sock
+
+    # The daemon's certificate is self-signed. We trust exactly that
+    # certificate, whatever name we reached it by.
+    context = ssl.create_default_context(cafile=cert)
+    context.check_hostname = False
+    return context.wrap_socket(sock)
+
+
+def start_daemon(host, port, detach, listen, cert):
     """Start the daemon, and return a connection to it"""
 
     home = os.path.expanduser('~')
@@ -650,6 +848,8 @@ def start_daemon(host, port):
             daemon=daemon,
             host=host,
             port=port,
+            detach=detach,
+            listen=listen,
             logdir=logdir)
     msg = "Starting daemon: {}".format(cmd)
     print(msg)
@@ -679,7 +879,7 @@ def start_daemon(host, port):
     while not is_ready:
         try:
             time.sleep(0.1)
-            sock = socket.create_connection((host, port))
+            sock = connect_daemon(host, port, listen, cert)
             is_ready = True
         except:
             is_ready = False
@@ -719,6 +919,19 @@ def stop_daemon():
     LOG.debug(out)
 
 
+def reload_daemon():
+    """Tell the daemon to read the config file again."""
+
+    daemon = DAEMON.format(arch=get_long_size())
+    cmd = CMD_RELOAD_DAEMON.format(daemon=daemon)
+    LOG.debug("Reloading the daemon: %s", cmd)
+
+    parts = cmd.split(" ")
+    out = subprocess.check_output(parts, stderr=subprocess.STDOUT)
+    out = out.decode("utf8")
+    LOG.debug(out)
+
+
 def get_long_size():
     """Size of a LONG in bits. Either "32" or "64".
     Used to determine which Go daemon to run.
@@ -2,6 +2,7 @@
 """Connection to hatcogd"""
 
 import logging
+import ssl
 
 LOG = logging.getLogger(__name__)
 
@@ -12,7 +13,7 @@ class Server(object):
     def __init__(self, sock):
 
         self.conn = sock
-        self.data = []
+        self.data = b''
 
     def write(self, msg):
         """Send a string message to the server"""
@@ -25,14 +26,25 @@ class Server(object):
         """Close server connection"""
         self.conn.close()
 
-    def receive_one(self):
-        """Listen for data on conn, return it if we have a full line"""
-
-        char = self.conn.recv(1)
-        if char == b'\n':
-            received = b''.join(self.data)
-            self.data = []
-            return received.decode("utf8")
+    def pending(self):
+        """Do we already have a full line. select can't see it."""
+        return b'\n' in self.data
 
-        self.data.append(char)
-        return None
+    def receive_one(self):
+        """Read what's waiting on conn, return a line if we have a full one"""
+
+        # Read until conn is empty. TLS can hold data select can't see.
+        while True:
+            try:
+                chunk = self.conn.recv(4096)
+            except (BlockingIOError, ssl.SSLWantReadError):
+                break
+            if not chunk:
+                break
+            self.data += chunk
+
+        if b'\n' not in self.data:
+            return None
+
+        received, self.data = self.data.split(b'\n', 1)
+        return received.decode("utf8")
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Shared secret clients must send, in logdir
+	TOKEN_NAME = "hatcogd.token"
+
+	// Random bytes in a new token
+	TOKEN_BYTES = 32
+
+	// How long a new client has to send /auth
+	AUTH_WAIT_NS = 10 * ONE_SECOND_NS
+
+	// TLS certificate and key for a TCP listener clients on other machines
+	// can reach, in logdir. Those clients need a copy of the certificate.
+	CERT_NAME = "hatcogd.crt"
+	KEY_NAME  = "hatcogd.key"
+
+	// How long a new certificate is good for
+	CERT_YEARS = 10
+)
+
+// Where the shared secret lives
+func tokenPath() string {
+	return filepath.Join(*logdir, TOKEN_NAME)
+}
+
+// Where our TLS certificate and its key live
+func certPaths() (string, string) {
+	return filepath.Join(*logdir, CERT_NAME), filepath.Join(*logdir, KEY_NAME)
+}
+
+// Can only this machine reach 'host'. Anywhere else we use TLS, so the
+// token isn't sent in clear text.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Read the shared secret clients authenticate with, creating it on first start.
+func loadToken(path string) (string, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) != 0 {
+		return strings.TrimSpace(string(data)), nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	secret := make([]byte, TOKEN_BYTES)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(secret)
+
+	err = ioutil.WriteFile(path, []byte(token+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	// WriteFile doesn't change the mode of an existing file
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Is 'content' an /auth line with the right token
+func isValidAuth(content, token string) bool {
+
+	parts := strings.SplitN(content, " ", 2)
+	if len(parts) != 2 || parts[0] != "/auth" || token == "" {
+		return false
+	}
+	given := strings.TrimSpace(parts[1])
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// Load our TLS certificate, creating a self-signed one on first start.
+// Clients check it's the same certificate, not who signed it.
+func loadCert(certPath, keyPath string) (tls.Certificate, error) {
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		return cert, nil
+	} else if _, statErr := os.Stat(certPath); !os.IsNotExist(statErr) {
+		return cert, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return cert, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return cert, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "hatcogd"},
+		DNSNames:              []string{"hatcogd"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(CERT_YEARS, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true, // So clients can trust it directly
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return cert, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return cert, err
+	}
+
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return cert, err
+	}
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return cert, err
+	}
+
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
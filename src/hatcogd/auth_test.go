@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadToken(t *testing.T) {
+
+	defer useTempLogdir(t)()
+
+	token, err := loadToken(tokenPath())
+	if err != nil {
+		t.Fatal("loadToken error:", err)
+	}
+	if len(token) != TOKEN_BYTES*2 {
+		t.Error("Token should be hex of TOKEN_BYTES. Got", token)
+	}
+
+	info, _ := os.Stat(tokenPath())
+	if info.Mode().Perm() != 0600 {
+		t.Error("Token file should be 0600. Got", info.Mode().Perm())
+	}
+
+	again, _ := loadToken(tokenPath())
+	if again != token {
+		t.Error("Token should be kept between starts")
+	}
+}
+
+func TestInternal_authentication(t *testing.T) {
+
+	defer useTempLogdir(t)()
+
+	fromUser := make(chan Message, 10)
+	manager := NewInternalManager("127.0.0.1", "0", fromUser)
+	manager.authWait = 50 * time.Millisecond
+	if err := manager.Listen(); err != nil {
+		t.Fatal("Listen error:", err)
+	}
+	defer manager.Close()
+	go manager.Run()
+	addr := manager.listeners[0].Addr().String()
+
+	// Wrong token
+	conn, _ := net.Dial("tcp", addr)
+	conn.Write([]byte("/auth nope\n/connect irc.example.com:6697\n"))
+	var line Line
+	data, _ := bufio.NewReader(conn).ReadBytes('\n')
+	json.Unmarshal(data, &line)
+	if line.Command != "ERROR" {
+		t.Error("Expected error line. Got", string(data))
+	}
+	if _, err := bufio.NewReader(conn).ReadByte(); err == nil {
+		t.Error("Connection should be closed")
+	}
+	conn.Close()
+
+	// No auth line at all
+	conn, _ = net.Dial("tcp", addr)
+	conn.Write([]byte("/connect irc.example.com:6697\n"))
+	data, _ = bufio.NewReader(conn).ReadBytes('\n')
+	json.Unmarshal(data, &line)
+	if line.Command != "ERROR" {
+		t.Error("Expected error line. Got", string(data))
+	}
+	conn.Close()
+
+	select {
+	case msg := <-fromUser:
+		t.Error("Unauthenticated clients should not reach the server. Got", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Says nothing
+	conn, _ = net.Dial("tcp", addr)
+	data, _ = bufio.NewReader(conn).ReadBytes('\n')
+	json.Unmarshal(data, &line)
+	if line.Command != "ERROR" {
+		t.Error("Silent client should be dropped. Got", string(data))
+	}
+	conn.Close()
+
+	// Right token
+	conn, _ = net.Dial("tcp", addr)
+	conn.Write([]byte("/auth " + manager.token + "\n/connect irc.example.com:6697\n"))
+	if msg := <-fromUser; msg.content != "/connect irc.example.com:6697" {
+		t.Error("Authenticated client should reach the server. Got", msg)
+	}
+	conn.Close()
+}
+
+// Bound beyond this machine, clients must use TLS and check our certificate
+func TestInternalManager_listenTLS(t *testing.T) {
+
+	defer useTempLogdir(t)()
+
+	fromUser := make(chan Message, 10)
+	manager := NewInternalManager("", "0", fromUser)
+	if err := manager.Listen(); err != nil {
+		t.Fatal("Listen error:", err)
+	}
+	defer manager.Close()
+	go manager.Run()
+	_, port, _ := net.SplitHostPort(manager.listeners[0].Addr().String())
+	addr := "127.0.0.1:" + port
+
+	certPath, keyPath := certPaths()
+	if info, err := os.Stat(keyPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("Key file should be 0600. Got", info, err)
+	}
+
+	// Clear text
+	conn, _ := net.Dial("tcp", addr)
+	conn.Write([]byte("/auth " + manager.token + "\n/connect irc.example.com:6697\n"))
+	select {
+	case msg := <-fromUser:
+		t.Error("Clear text clients should not reach the server. Got", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.Close()
+
+	certPEM, _ := ioutil.ReadFile(certPath)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	tlsConn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "hatcogd"})
+	if err != nil {
+		t.Fatal("TLS client with our certificate should connect:", err)
+	}
+	tlsConn.Write([]byte("/auth " + manager.token + "\n/connect irc.example.com:6697\n"))
+	if msg := <-fromUser; msg.content != "/connect irc.example.com:6697" {
+		t.Error("TLS client should reach the server. Got", msg)
+	}
+	tlsConn.Close()
+
+	// Same certificate next start, so clients' copies stay valid
+	again, err := loadCert(certPath, keyPath)
+	block, _ := pem.Decode(certPEM)
+	if err != nil || len(again.Certificate) == 0 || !bytes.Equal(again.Certificate[0], block.Bytes) {
+		t.Error("Should load the certificate we made. Got", err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+var (
+	// IRCv3 capabilities we ask for, if the server offers them
+	CAPS_WANTED = []string{"message-tags", "multi-prefix", "server-time"}
+)
+
+// Capability negotiation state for one External.
+// See http://ircv3.net/specs/core/capability-negotiation-3.2.html
+type Capabilities struct {
+	available     map[string]string // From CAP LS / NEW, name -> value
+	enabled       map[string]bool   // ACKed by the server
+	isNegotiating bool              // true until we send CAP END
+	lsDone        bool              // Received the last line of CAP LS
+}
+
+func NewCapabilities() *Capabilities {
+	return &Capabilities{
+		available: make(map[string]string),
+		enabled:   make(map[string]bool),
+	}
+}
+
+// Is capability 'name' enabled on this connection
+func (self *Capabilities) Has(name string) bool {
+	return self.enabled[name]
+}
+
+// Value the server advertised for capability 'name', e.g. "PLAIN,EXTERNAL" for sasl
+func (self *Capabilities) Value(name string) string {
+	return self.available[name]
+}
+
+// Sorted names of enabled capabilities
+func (self *Capabilities) Enabled() []string {
+	names := make([]string, 0, len(self.enabled))
+	for name := range self.enabled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Record capabilities from a CAP LS or CAP NEW list.
+// Returns the names we want and don't have yet.
+func (self *Capabilities) offered(list string, wanted []string) []string {
+
+	var toRequest []string
+
+	for _, capStr := range strings.Fields(list) {
+		parts := strings.SplitN(capStr, "=", 2)
+		name := parts[0]
+		if len(parts) == 2 {
+			self.available[name] = parts[1]
+		} else {
+			self.available[name] = ""
+		}
+	}
+
+	for _, name := range wanted {
+		if _, ok := self.available[name]; ok && !self.enabled[name] {
+			toRequest = append(toRequest, name)
+		}
+	}
+	return toRequest
+}
+
+// Record server acknowledgement of a CAP REQ
+func (self *Capabilities) acked(list string) {
+	for _, name := range strings.Fields(list) {
+		if strings.HasPrefix(name, "-") {
+			delete(self.enabled, name[1:])
+		} else {
+			self.enabled[name] = true
+		}
+	}
+}
+
+// Record capabilities the server no longer offers (CAP DEL)
+func (self *Capabilities) deleted(list string) {
+	for _, name := range strings.Fields(list) {
+		delete(self.available, name)
+		delete(self.enabled, name)
+	}
+}
+
+// Capabilities we want from this server
+func (self *External) wantedCaps() []string {
+	return append([]string{"sasl"}, CAPS_WANTED...)
+}
+
+// Start capability negotiation. Server holds registration until CAP END.
+func (self *External) startCap() {
+	self.caps = NewCapabilities()
+	self.caps.isNegotiating = true
+	self.sendRaw("CAP LS 302")
+}
+
+// Finish capability negotiation, allowing registration to complete
+func (self *External) endCap() {
+	if !self.caps.isNegotiating {
+		return
+	}
+	self.caps.isNegotiating = false
+	self.sendRaw("CAP END")
+	self.emit(self.capsLine())
+}
+
+// Act on a CAP line from the server
+func (self *External) onCap(line *Line) {
+
+	if len(line.Args) < 2 {
+		log.Println("Invalid CAP line:", line.Raw)
+		return
+	}
+	subCommand := line.Args[1]
+
+	// Single capabilities may be sent without a leading :
+	list := line.Content
+	isMore := false
+	if len(line.Args) > 2 {
+		if line.Args[2] == "*" { // Multi-line reply, more to come
+			isMore = true
+		} else if list == "" {
+			list = line.Args[len(line.Args)-1]
+		}
+	}
+
+	switch subCommand {
+
+	case "LS":
+		// offered remembers every line, so the last one gives us all we want
+		toRequest := self.caps.offered(list, self.wantedCaps())
+		if isMore {
+			return
+		}
+		self.caps.lsDone = true
+		self.requestCaps(toRequest)
+
+	case "NEW":
+		self.requestCaps(self.caps.offered(list, self.wantedCaps()))
+
+	case "ACK":
+		self.caps.acked(list)
+		log.Println("Capabilities enabled on", self.network, ":", self.caps.Enabled())
+		if self.caps.isNegotiating {
+			self.maybeStartSasl()
+		} else {
+			self.emit(self.capsLine())
+		}
+
+	case "NAK":
+		log.Println("Capabilities refused on", self.network, ":", list)
+		self.maybeStartSasl()
+
+	case "DEL":
+		self.caps.deleted(list)
+		self.emit(self.capsLine())
+	}
+}
+
+// Ask for capabilities, or end negotiation if there are none to ask for
+func (self *External) requestCaps(names []string) {
+	if len(names) == 0 {
+		self.maybeStartSasl()
+		return
+	}
+	self.sendRaw("CAP REQ :" + strings.Join(names, " "))
+}
+
+// Synthetic line telling clients which capabilities are enabled
+func (self *External) capsLine() *Line {
+	enabled := self.caps.Enabled()
+	line := NewLine(self.network, "CAPS", strings.Join(enabled, " "))
+	line.Args = enabled
+	return line
+}
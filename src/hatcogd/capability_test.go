@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCapabilities_offered(t *testing.T) {
+
+	caps := NewCapabilities()
+	toRequest := caps.offered("multi-prefix sasl=PLAIN,EXTERNAL away-notify", []string{"sasl", "multi-prefix", "server-time"})
+
+	if strings.Join(toRequest, " ") != "sasl multi-prefix" {
+		t.Error("Requested caps incorrect. Got", toRequest)
+	}
+	if caps.Value("sasl") != "PLAIN,EXTERNAL" {
+		t.Error("Cap value incorrect. Got", caps.Value("sasl"))
+	}
+
+	caps.acked("multi-prefix sasl")
+	if !caps.Has("sasl") || !caps.Has("multi-prefix") {
+		t.Error("ACK not recorded. Got", caps.Enabled())
+	}
+
+	toRequest = caps.offered("server-time", []string{"sasl", "multi-prefix", "server-time"})
+	if len(toRequest) != 1 || toRequest[0] != "server-time" {
+		t.Error("CAP NEW request incorrect. Got", toRequest)
+	}
+
+	caps.acked("-multi-prefix")
+	caps.deleted("sasl")
+	if caps.Has("sasl") || caps.Has("multi-prefix") {
+		t.Error("Disabled caps still enabled. Got", caps.Enabled())
+	}
+}
+
+func TestExternal_capLsMultiLine(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	ext := &External{
+		network:    "irc.example.com:6697",
+		socket:     client,
+		fromServer: make(chan *Line, 10),
+		rawLog:     log.New(ioutil.Discard, "", 0),
+		caps:       NewCapabilities(),
+	}
+	ext.caps.isNegotiating = true
+
+	sent := make(chan string, 10)
+	go func() {
+		bufRead := bufio.NewReader(server)
+		for {
+			content, err := bufRead.ReadString('\n')
+			if err != nil {
+				return
+			}
+			sent <- strings.TrimRight(content, "\n")
+		}
+	}()
+
+	line, _ := ParseLine(":irc.example.com CAP * LS * :multi-prefix away-notify")
+	ext.onCap(line)
+	line, _ = ParseLine(":irc.example.com CAP * LS :server-time")
+	ext.onCap(line)
+
+	if got := <-sent; got != "CAP REQ :multi-prefix server-time" {
+		t.Error("Should request each cap once, after the last LS line. Sent", got)
+	}
+}
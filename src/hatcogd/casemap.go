@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	// CASEMAPPING values from RPL_ISUPPORT
+	CASEMAPPING_ASCII          = "ascii"          // A-Z are a-z
+	CASEMAPPING_RFC1459        = "rfc1459"        // Also []\~ are {}|^
+	CASEMAPPING_STRICT_RFC1459 = "strict-rfc1459" // Also []\ are {}|
+)
+
+var (
+	rfc1459Folder = strings.NewReplacer("[", "{", "]", "}", "\\", "|", "~", "^")
+	strictFolder  = strings.NewReplacer("[", "{", "]", "}", "\\", "|")
+)
+
+// The form of a nick or channel name that is the same for every way of
+// writing it, under the server's casemapping. Compare these, not names.
+// We treat casemappings we don't know as ascii.
+func foldCase(casemapping, name string) string {
+
+	folded := asciiLower(name)
+
+	switch casemapping {
+	case CASEMAPPING_RFC1459:
+		return rfc1459Folder.Replace(folded)
+	case CASEMAPPING_STRICT_RFC1459:
+		return strictFolder.Replace(folded)
+	}
+	return folded
+}
+
+// Only A-Z, other letters are different nicks on IRC
+func asciiLower(name string) string {
+
+	for i := 0; i < len(name); i++ {
+		if 'A' <= name[i] && name[i] <= 'Z' {
+			lower := []byte(name)
+			for j := i; j < len(lower); j++ {
+				if 'A' <= lower[j] && lower[j] <= 'Z' {
+					lower[j] += 'a' - 'A'
+				}
+			}
+			return string(lower)
+		}
+	}
+	return name
+}
+
+// Are two nicks or channel names the same, under 'casemapping'
+func isSameName(casemapping, a, b string) bool {
+	return foldCase(casemapping, a) == foldCase(casemapping, b)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFoldCase(t *testing.T) {
+
+	checks := []struct{ casemapping, name, expected string }{
+		{CASEMAPPING_ASCII, "#Go-Nuts[]~", "#go-nuts[]~"},
+		{CASEMAPPING_RFC1459, "Bob[Away]\\~", "bob{away}|^"},
+		{CASEMAPPING_STRICT_RFC1459, "Bob[Away]\\~", "bob{away}|~"},
+		{"rfc7613", "BÖB", "bÖb"}, // Unknown is ascii
+	}
+	for _, check := range checks {
+		if got := foldCase(check.casemapping, check.name); got != check.expected {
+			t.Error("Folding", check.name, "with", check.casemapping, "expected", check.expected, "Got", got)
+		}
+	}
+	if !isSameName(CASEMAPPING_RFC1459, "nick[m]", "NICK{M}") || isSameName(CASEMAPPING_ASCII, "nick[m]", "nick{m}") {
+		t.Error("Bad isSameName")
+	}
+}
+
+func TestInternalManager_caseMapping(t *testing.T) {
+
+	manager := NewInternalManager("", "", make(chan Message, 10))
+	network := "irc.example.com:6697"
+	_, conn := newTestInternal(manager, "#Go")
+	_, private := newTestInternal(manager, "bob[away]")
+
+	manager.WriteChannel(network, "#go", []byte("{}\n"))
+	if got := <-conn.written; got != "{}\n" {
+		t.Error("#go should go to the #Go window. Got", got)
+	}
+	if !manager.HasChannel(network, "#GO") {
+		t.Error("HasChannel should ignore case")
+	}
+
+	line, _ := ParseLine(":Bob{Away}!b@example.com PRIVMSG hatcog :hi")
+	line.Network = network
+	if manager.QueuePrivate(line) != 0 {
+		t.Error("rfc1459: Bob{Away} is bob[away], who has a window")
+	}
+	manager.Record(line)
+	if len(manager.Backlog(network, "BOB[AWAY]", 10)) != 1 {
+		t.Error("Scrollback should ignore case")
+	}
+
+	// With ascii, [] and {} are different
+	manager.SetCaseMapping(network, CASEMAPPING_ASCII)
+	if manager.QueuePrivate(line) == 0 {
+		t.Error("ascii: Bob{Away} is not bob[away]")
+	}
+	select {
+	case got := <-private.written:
+		t.Error("Nothing should be written to bob[away]. Got", got)
+	default:
+	}
+}
+
+func TestExternal_trackChannelsCase(t *testing.T) {
+
+	ext, _ := newTestExternal()
+	ext.nick = "Hatcog"
+	ext.doCommand("/JOIN #Go secret")
+
+	serverSays(ext, ":hatcog!h@example.com JOIN #go")
+	if ext.channels["#go"] != "secret" {
+		t.Error("Should remember the key whatever the case. Got", ext.channels)
+	}
+	serverSays(ext, ":HATCOG!h@example.com PART #GO")
+	if len(ext.channels) != 0 {
+		t.Error("Should leave #go. Got", ext.channels)
+	}
+}
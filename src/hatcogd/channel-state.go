@@ -0,0 +1,347 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	RPL_CHANNELMODEIS = "324"
+	RPL_CREATIONTIME  = "329"
+	RPL_TOPIC         = "332"
+	RPL_TOPICWHOTIME  = "333"
+)
+
+// What we know about a channel we're in, from the lines the server sends
+type ChannelState struct {
+	name      string
+	topic     string
+	topicBy   string
+	topicTime int64             // Unix time
+	modes     map[byte]string   // Channel modes, and their parameter if they have one
+	created   int64             // Unix time
+	members   map[string]string // Folded nick to prefix and nick, e.g. "@Bob"
+}
+
+func NewChannelState(name string) *ChannelState {
+	return &ChannelState{
+		name:    name,
+		modes:   make(map[byte]string),
+		members: make(map[string]string)}
+}
+
+// A channel's state, sent to a window when it opens on a channel we're in
+type ChannelSnapshot struct {
+	Line
+	Topic     string
+	TopicBy   string
+	TopicTime int64
+	Modes     string // e.g. "+klnt secret 10"
+	Created   int64
+	Members   []string // With prefixes, highest rank first
+	Prefixes  string   // Prefix symbols the network uses, highest rank first
+}
+
+// Snapshot as json, with our fields
+func (self *ChannelSnapshot) AsJson() []byte {
+	return asJson(self)
+}
+
+// Update our channel state from a line. Call with lock held.
+func (self *External) updateChannelState(line *Line) {
+
+	switch line.Command {
+
+	case "JOIN":
+		if self.isMe(line.User) {
+			// Server sends NAMES, topic, etc next
+			self.chanStates[self.fold(line.Channel)] = NewChannelState(line.Channel)
+		} else if state := self.chanState(line.Channel); state != nil {
+			state.members[self.fold(line.User)] = line.User
+		}
+
+	case "PART":
+		self.removeMember(line.Channel, line.User)
+
+	case "KICK":
+		if len(line.Args) > 1 {
+			self.removeMember(line.Channel, line.Args[1])
+		}
+
+	case "QUIT":
+		line.Channels = self.memberOf(line.User)
+		for _, state := range self.chanStates {
+			delete(state.members, self.fold(line.User))
+		}
+
+	case "NICK":
+		line.Channels = self.memberOf(line.User)
+		self.renameMember(line.User, line.Content)
+
+	case "MODE":
+		// "MODE #chan +o-v alice bob"
+		params := allParams(line)
+		if state := self.chanState(line.Channel); state != nil && len(params) > 1 {
+			self.applyModes(state, params[1], params[2:])
+		}
+
+	case "TOPIC":
+		if state := self.chanState(line.Channel); state != nil {
+			state.topic = line.Content
+			state.topicBy = line.User
+			state.topicTime = line.ReceivedTime().Unix()
+		}
+
+	case RPL_NAMREPLY:
+		// "353 me = #chan :@alice +bob carol"
+		if state := self.chanState(line.Channel); state != nil {
+			for _, nick := range strings.Fields(line.Content) {
+				_, bare := self.isupport.SplitPrefix(nick)
+				state.members[self.fold(bare)] = nick
+			}
+		}
+
+	case RPL_TOPIC:
+		if state := self.chanState(line.Channel); state != nil {
+			state.topic = line.Content
+		}
+
+	case RPL_TOPICWHOTIME:
+		// "333 me #chan setter 1234567890"
+		if state := self.chanState(line.Channel); state != nil && len(line.Args) > 3 {
+			state.topicBy = line.Args[2]
+			state.topicTime, _ = strconv.ParseInt(line.Args[3], 10, 64)
+		}
+
+	case RPL_CHANNELMODEIS:
+		// "324 me #chan +klnt secret 10"
+		params := allParams(line)
+		if state := self.chanState(line.Channel); state != nil && len(params) > 2 {
+			state.modes = make(map[byte]string)
+			self.applyModes(state, params[2], params[3:])
+		}
+
+	case RPL_CREATIONTIME:
+		// "329 me #chan 1234567890"
+		if state := self.chanState(line.Channel); state != nil && len(line.Args) > 2 {
+			state.created, _ = strconv.ParseInt(line.Args[2], 10, 64)
+		}
+	}
+}
+
+// The line's args, and the trailing part if there is one. Servers may send
+// the last parameter either way.
+func allParams(line *Line) []string {
+	if line.Content == "" {
+		return line.Args
+	}
+	return append(line.Args[:len(line.Args):len(line.Args)], line.Content)
+}
+
+// State of a channel we're in, or nil. Call with lock held.
+func (self *External) chanState(channel string) *ChannelState {
+	if channel == "" {
+		return nil
+	}
+	return self.chanStates[self.fold(channel)]
+}
+
+// Names of the channels 'nick' is in, sorted. Call with lock held.
+func (self *External) memberOf(nick string) []string {
+
+	var channels []string
+	for _, state := range self.chanStates {
+		if _, ok := state.members[self.fold(nick)]; ok {
+			channels = append(channels, state.name)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// 'nick' left 'channel'. If it's us, forget the channel. Call with lock held.
+func (self *External) removeMember(channel, nick string) {
+	if self.isMe(nick) {
+		delete(self.chanStates, self.fold(channel))
+		return
+	}
+	if state := self.chanState(channel); state != nil {
+		delete(state.members, self.fold(nick))
+	}
+}
+
+// 'oldNick' is now 'newNick', in every channel. Call with lock held.
+func (self *External) renameMember(oldNick, newNick string) {
+
+	if oldNick == "" || newNick == "" {
+		return
+	}
+	for _, state := range self.chanStates {
+		member, ok := state.members[self.fold(oldNick)]
+		if !ok {
+			continue
+		}
+		prefix, _ := self.isupport.SplitPrefix(member)
+		delete(state.members, self.fold(oldNick))
+		state.members[self.fold(newNick)] = prefix + newNick
+	}
+}
+
+// Apply a mode change like "+o-v alice bob" or "+kl secret 10" to a channel.
+// Which modes take a parameter comes from PREFIX and CHANMODES.
+// Call with lock held.
+func (self *External) applyModes(state *ChannelState, changes string, params []string) {
+
+	prefixModes, prefixSymbols := self.isupport.Prefixes()
+	chanModes, _ := self.isupport.Get("CHANMODES")
+	types := strings.Split(chanModes, ",")
+	for len(types) < 4 {
+		types = append(types, "")
+	}
+	// A: lists, B: always a parameter, C: parameter when set, D: no parameter
+	listModes, alwaysParam, setParam := types[0], types[1], types[2]
+
+	nextParam := func() string {
+		if len(params) == 0 {
+			return ""
+		}
+		param := params[0]
+		params = params[1:]
+		return param
+	}
+
+	isAdding := true
+	for i := 0; i < len(changes); i++ {
+		mode := changes[i]
+
+		switch {
+		case mode == '+':
+			isAdding = true
+
+		case mode == '-':
+			isAdding = false
+
+		case strings.IndexByte(prefixModes, mode) != -1:
+			nick := nextParam()
+			symbol := prefixSymbols[strings.IndexByte(prefixModes, mode)]
+			self.setMemberPrefix(state, nick, symbol, isAdding)
+
+		case strings.IndexByte(listModes, mode) != -1:
+			// Bans, exceptions, etc. We don't keep the lists.
+			nextParam()
+
+		case strings.IndexByte(alwaysParam, mode) != -1:
+			param := nextParam()
+			if isAdding {
+				state.modes[mode] = param
+			} else {
+				delete(state.modes, mode)
+			}
+
+		case strings.IndexByte(setParam, mode) != -1:
+			if isAdding {
+				state.modes[mode] = nextParam()
+			} else {
+				delete(state.modes, mode)
+			}
+
+		default:
+			if isAdding {
+				state.modes[mode] = ""
+			} else {
+				delete(state.modes, mode)
+			}
+		}
+	}
+}
+
+// Give a member a prefix (@, +, etc), or take it away. Keeps prefixes in
+// rank order, like multi-prefix NAMES. Call with lock held.
+func (self *External) setMemberPrefix(state *ChannelState, nick string, symbol byte, isAdding bool) {
+
+	member, ok := state.members[self.fold(nick)]
+	if !ok {
+		return
+	}
+	prefix, bare := self.isupport.SplitPrefix(member)
+
+	_, symbols := self.isupport.Prefixes()
+	newPrefix := ""
+	for i := 0; i < len(symbols); i++ {
+		has := strings.IndexByte(prefix, symbols[i]) != -1
+		if symbols[i] == symbol {
+			has = isAdding
+		}
+		if has {
+			newPrefix += string(symbols[i])
+		}
+	}
+	state.members[self.fold(nick)] = newPrefix + bare
+}
+
+// Snapshot of a channel we're in, or nil if we're not in it
+func (self *External) ChannelSnapshot(channel string) *ChannelSnapshot {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	state := self.chanState(channel)
+	if state == nil {
+		return nil
+	}
+
+	snapshot := &ChannelSnapshot{
+		Line:      *NewLine(self.network, "CHANNEL", state.topic),
+		Topic:     state.topic,
+		TopicBy:   state.topicBy,
+		TopicTime: state.topicTime,
+		Modes:     modeString(state.modes),
+		Created:   state.created,
+	}
+	snapshot.Channel = state.name
+
+	_, symbols := self.isupport.Prefixes()
+	snapshot.Prefixes = symbols
+	rank := func(member string) int {
+		if member != "" && strings.IndexByte(symbols, member[0]) != -1 {
+			return strings.IndexByte(symbols, member[0])
+		}
+		return len(symbols)
+	}
+	for _, member := range state.members {
+		snapshot.Members = append(snapshot.Members, member)
+	}
+	sort.Slice(snapshot.Members, func(i, j int) bool {
+		a, b := snapshot.Members[i], snapshot.Members[j]
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		_, bareA := self.isupport.SplitPrefix(a)
+		_, bareB := self.isupport.SplitPrefix(b)
+		return self.fold(bareA) < self.fold(bareB)
+	})
+
+	return snapshot
+}
+
+// Channel modes as the server would show them: "+klnt secret 10"
+func modeString(modes map[byte]string) string {
+
+	if len(modes) == 0 {
+		return ""
+	}
+
+	letters := make([]byte, 0, len(modes))
+	for mode := range modes {
+		letters = append(letters, mode)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+
+	params := []string{"+" + string(letters)}
+	for _, mode := range letters {
+		if modes[mode] != "" {
+			params = append(params, modes[mode])
+		}
+	}
+	return strings.Join(params, " ")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestExternal_channelState(t *testing.T) {
+
+	ext, _ := newTestExternal()
+	ext.nick = "hatcog"
+	serverSays(ext, ":irc.example.com 005 hatcog PREFIX=(qov)~@+ CHANMODES=beI,k,l,imnpst :are supported")
+
+	serverSays(ext, ":hatcog!h@example.com JOIN #test")
+	serverSays(ext, ":irc.example.com 332 hatcog #test :Welcome")
+	serverSays(ext, ":irc.example.com 333 hatcog #test alice 1500000000")
+	serverSays(ext, ":irc.example.com 353 hatcog = #test :hatcog @alice +bob ~carol")
+	serverSays(ext, ":irc.example.com 324 hatcog #test +ntk secret")
+	serverSays(ext, ":irc.example.com 329 hatcog #test 1400000000")
+
+	snapshot := ext.ChannelSnapshot("#TEST")
+	if snapshot == nil {
+		t.Fatal("Should have state for #test")
+	}
+	if snapshot.Command != "CHANNEL" || snapshot.Channel != "#test" || snapshot.Topic != "Welcome" ||
+		snapshot.TopicBy != "alice" || snapshot.TopicTime != 1500000000 || snapshot.Created != 1400000000 {
+		t.Error("Bad snapshot. Got", snapshot)
+	}
+	if snapshot.Modes != "+knt secret" {
+		t.Error("Bad modes. Got", snapshot.Modes)
+	}
+	if strings.Join(snapshot.Members, " ") != "~carol @alice +bob hatcog" {
+		t.Error("Members should be by rank then nick. Got", snapshot.Members)
+	}
+	if snapshot.Prefixes != "~@+" {
+		t.Error("Snapshot should have the network's prefixes. Got", snapshot.Prefixes)
+	}
+
+	serverSays(ext, ":alice!a@example.com MODE #test +v-k+l hatcog secret 10")
+	serverSays(ext, ":bob!b@example.com NICK :robert")
+	topic, _ := ParseLine(":alice!a@example.com TOPIC #test :New topic")
+	topic.Received = "2017-07-14T02:40:00Z" // From server-time
+	ext.act(topic)
+	serverSays(ext, ":dave!d@example.com JOIN #test")
+	serverSays(ext, ":carol!c@example.com QUIT :bye")
+	serverSays(ext, ":alice!a@example.com KICK #test dave :out")
+	serverSays(ext, ":alice!a@example.com MODE #test -o alice")
+
+	snapshot = ext.ChannelSnapshot("#test")
+	if snapshot.Modes != "+lnt 10" || snapshot.Topic != "New topic" || snapshot.TopicBy != "alice" ||
+		snapshot.TopicTime != 1500000000 {
+		t.Error("Bad snapshot after changes. Got", snapshot)
+	}
+	if strings.Join(snapshot.Members, " ") != "+hatcog +robert alice" {
+		t.Error("Bad members after changes. Got", snapshot.Members)
+	}
+
+	serverSays(ext, ":hatcog!h@example.com PART #test")
+	if ext.ChannelSnapshot("#test") != nil {
+		t.Error("Should forget #test when we leave it")
+	}
+}
+
+func TestServer_channelStateOnJoin(t *testing.T) {
+
+	manager := NewInternalManager("", "", make(chan Message, 10))
+	ext, _ := newTestExternal()
+	ext.nick = "hatcog"
+	ext.isRegistered = true
+	serverSays(ext, ":hatcog!h@example.com JOIN #test")
+	serverSays(ext, ":irc.example.com 353 hatcog = #test :hatcog @alice")
+	server := &Server{
+		internal: manager,
+		external: &ExternalManager{connections: map[string]*External{ext.network: ext}, config: NewConfig()},
+	}
+
+	legacy, legacyConn := newTestInternal(manager, "#test")
+	server.onUser(Message{ext.network, "#test", "/join #test", legacy, nil})
+
+	modern, modernConn := newTestInternal(manager, "#test")
+	modern.Special("/hello 1 channel-state")
+	server.onUser(Message{"", "", "/hello 1 channel-state", modern, nil})
+	<-modernConn.written // HELLO
+	server.onUser(Message{ext.network, "#test", "/join #test,#other", modern, nil})
+
+	var snapshot ChannelSnapshot
+	json.Unmarshal([]byte(<-modernConn.written), &snapshot)
+	if snapshot.Command != "CHANNEL" || snapshot.Channel != "#test" || len(snapshot.Members) != 2 {
+		t.Error("Client should get the state of #test. Got", snapshot)
+	}
+	select {
+	case got := <-modernConn.written:
+		t.Error("We're not in #other, nothing should be sent. Got", got)
+	case got := <-legacyConn.written:
+		t.Error("Client that didn't ask for channel-state should get nothing. Got", got)
+	default:
+	}
+}
+
+// A channel-state client gets the user list in the CHANNEL line, not from NAMES
+func TestInternal_reattachChannelState(t *testing.T) {
+
+	defer func(previous bool) { *detach = previous }(*detach)
+	*detach = true
+
+	fromUser := make(chan Message, 10)
+	manager := NewInternalManager("", "", fromUser)
+
+	first, firstConn := newTestInternal(manager, "#test")
+	close(firstConn.input)
+	first.Run()
+
+	modern, _ := newTestInternal(manager, "")
+	modern.Special("/hello 1 channel-state")
+	modern.Special("/join #test")
+
+	select {
+	case msg := <-fromUser:
+		t.Error("Reattach should not ask for NAMES. Got", msg.content)
+	default:
+	}
+}
+
+func TestServer_quitAndNickRouting(t *testing.T) {
+
+	manager := NewInternalManager("", "", make(chan Message, 10))
+	ext, _ := newTestExternal()
+	ext.nick = "hatcog"
+	ext.isRegistered = true
+	manager.SetNick(ext.network, "hatcog")
+	server := &Server{
+		internal: manager,
+		external: &ExternalManager{connections: map[string]*External{ext.network: ext}, config: NewConfig()},
+	}
+	serverSays(ext, ":hatcog!h@example.com JOIN #a")
+	serverSays(ext, ":irc.example.com 353 hatcog = #a :hatcog alice @bob")
+	serverSays(ext, ":hatcog!h@example.com JOIN #b")
+	serverSays(ext, ":irc.example.com 353 hatcog = #b :hatcog bob")
+	for len(ext.fromServer) > 0 {
+		<-ext.fromServer
+	}
+
+	_, chanA := newTestInternal(manager, "#A")
+	_, chanB := newTestInternal(manager, "#b")
+	_, chanC := newTestInternal(manager, "#c")
+	_, private := newTestInternal(manager, "alice")
+
+	expect := func(conn *fakeConn, command string) {
+		select {
+		case got := <-conn.written:
+			if !strings.Contains(got, `"Command":"`+command+`"`) {
+				t.Error("Expected", command, "Got", got)
+			}
+		default:
+			t.Error("Expected", command, "Got nothing")
+		}
+	}
+	expectNothing := func() {
+		for _, conn := range []*fakeConn{chanA, chanB, chanC, private} {
+			select {
+			case got := <-conn.written:
+				t.Error("Unexpected write", got)
+			default:
+			}
+		}
+	}
+
+	serverSays(ext, ":alice!a@example.com QUIT :bye")
+	line := <-ext.fromServer
+	if len(line.Channels) != 1 || line.Channels[0] != "#a" {
+		t.Error("alice was only in #a. Got", line.Channels)
+	}
+	server.onServer(line)
+	expect(chanA, "QUIT")
+	expect(private, "QUIT")
+	expectNothing()
+
+	serverSays(ext, ":bob!b@example.com NICK :robert")
+	server.onServer(<-ext.fromServer)
+	expect(chanA, "NICK")
+	expect(chanB, "NICK")
+	expectNothing()
+
+	// Scrollback has them in each channel the user was in
+	backlogA := manager.Backlog(ext.network, "#a", 10)
+	backlogB := manager.Backlog(ext.network, "#b", 10)
+	if len(backlogA) != 2 || backlogA[0].Command != "QUIT" || backlogA[1].Command != "NICK" {
+		t.Error("#a should have the QUIT and NICK. Got", backlogA)
+	}
+	if len(backlogB) != 1 || backlogB[0].Command != "NICK" || !backlogB[0].IsReplay {
+		t.Error("#b should have the NICK. Got", backlogB)
+	}
+
+	// We asked for a nick, but someone else took it. Not a change to ours.
+	server.onUser(Message{ext.network, "#a", "/nick wanted", nil, nil})
+	serverSays(ext, ":dave!d@example.com NICK :wanted")
+	server.onServer(<-ext.fromServer)
+	expectNothing()
+
+	// Our own nick change goes everywhere
+	serverSays(ext, ":hatcog!h@example.com NICK :hatcog_")
+	server.onServer(<-ext.fromServer)
+	for _, conn := range []*fakeConn{chanA, chanB, chanC, private} {
+		expect(conn, "NICK")
+	}
+	if manager.GetNick(ext.network) != "hatcog_" {
+		t.Error("Should record our new nick. Got", manager.GetNick(ext.network))
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// Config file, in the user's home directory. hjoin reads it too.
+	CONFIG_NAME = ".hatcogrc"
+
+	// How long a $(command) password gets, e.g. for gpg to ask for a passphrase
+	PASSWORD_CMD_NS = 60 * ONE_SECOND_NS
+)
+
+// A network from the config file:
+//
+//	name = host:port[:server_password],nick,password,Real Name
+//
+// If password is wrapped in $( and ), we run it and the output is the password.
+type NetworkConfig struct {
+	Name       string
+	Address    string // host:port
+	ServerPass string // PASS command
+	Nick       string
+	Password   string // For SASL or NickServ, maybe a $(command)
+	RealName   string
+}
+
+// What we read from the config file
+type Config struct {
+	Networks map[string]*NetworkConfig
+	Settings map[string]string // Everything that isn't a network: daemon_port, cmd_notify, etc
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Networks: make(map[string]*NetworkConfig),
+		Settings: make(map[string]string)}
+}
+
+// Where the config file is: -config, or ~/.hatcogrc
+func configPath() string {
+	if *configFile != "" {
+		return *configFile
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return CONFIG_NAME
+	}
+	return filepath.Join(home, CONFIG_NAME)
+}
+
+// Read the config file. A missing file is an empty config, because clients
+// can still /connect to an address.
+func loadConfig(path string) (*Config, error) {
+
+	config := NewConfig()
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Println("No config file at", path)
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			log.Println("Ignoring config line without =:", line)
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.Trim(parts[1], " \"'")
+
+		if strings.HasPrefix(key, "cmd_") || strings.HasPrefix(key, "daemon_") {
+			config.Settings[key] = value
+			continue
+		}
+
+		network, err := parseNetwork(key, value)
+		if err != nil {
+			log.Println("Ignoring network", key, ":", err)
+			continue
+		}
+		config.Networks[key] = network
+	}
+
+	return config, scanner.Err()
+}
+
+// Parse the value of a network line: host:port[:pass],nick,password,Real Name
+func parseNetwork(name, value string) (*NetworkConfig, error) {
+
+	parts := strings.SplitN(value, ",", 4)
+	if len(parts) < 3 {
+		return nil, errors.New("Expected host:port,nick,password,Real Name. Got: " + value)
+	}
+
+	address, pass := splitNetPass(strings.TrimSpace(parts[0]))
+	network := &NetworkConfig{
+		Name:       name,
+		Address:    address,
+		ServerPass: pass,
+		Nick:       strings.TrimSpace(parts[1]),
+		Password:   strings.TrimSpace(parts[2]),
+	}
+	if len(parts) == 4 {
+		network.RealName = strings.TrimSpace(parts[3])
+	}
+	if network.RealName == "" {
+		network.RealName = network.Nick
+	}
+	return network, nil
+}
+
+// Network names, sorted
+func (self *Config) Names() []string {
+	names := make([]string, 0, len(self.Networks))
+	for name := range self.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// USER command to register with
+func (self *NetworkConfig) userCmd() string {
+	return "USER " + self.Nick + " 0 * :" + self.RealName
+}
+
+// The password, running the command if it's a $(command). The command runs
+// in a shell, so it can use pipes and quotes. Takes up to PASSWORD_CMD_NS,
+// so don't call it holding a lock.
+func (self *NetworkConfig) password() string {
+
+	if !strings.HasPrefix(self.Password, "$(") || !strings.HasSuffix(self.Password, ")") {
+		return self.Password
+	}
+
+	command := strings.TrimSpace(self.Password[2 : len(self.Password)-1])
+	if command == "" {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PASSWORD_CMD_NS)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "sh", "-c", command).Output()
+	if err != nil {
+		log.Println("Error running password command for", self.Name, ":", err)
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "hatcogd")
+	defer os.RemoveAll(dir)
+	path := dir + "/hatcogrc"
+	ioutil.WriteFile(path, []byte(`# Comment
+freenode = chat.freenode.net:6697,hatcog_user,$(echo s3cret),Hatcog User
+mycompany = irc.example.com:6697:serverpass,corp_user,,Corp User
+broken = irc.example.com:6697
+daemon_port = "8790"
+cmd_url = "/usr/bin/sensible-browser"
+`), 0600)
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal("Error loading config:", err)
+	}
+	if names := config.Names(); len(names) != 2 || names[0] != "freenode" || names[1] != "mycompany" {
+		t.Error("Expected freenode and mycompany. Got", names)
+	}
+	if config.Settings["daemon_port"] != "8790" || config.Settings["cmd_url"] != "/usr/bin/sensible-browser" {
+		t.Error("Bad settings. Got", config.Settings)
+	}
+
+	freenode := config.Networks["freenode"]
+	if freenode.Address != "chat.freenode.net:6697" || freenode.Nick != "hatcog_user" ||
+		freenode.RealName != "Hatcog User" || freenode.password() != "s3cret" {
+		t.Error("Bad freenode config. Got", freenode)
+	}
+	if freenode.userCmd() != "USER hatcog_user 0 * :Hatcog User" {
+		t.Error("Bad USER command. Got", freenode.userCmd())
+	}
+	if mycompany := config.Networks["mycompany"]; mycompany.ServerPass != "serverpass" || mycompany.password() != "" {
+		t.Error("Bad mycompany config. Got", mycompany)
+	}
+
+	// No config file is fine, clients connect by address
+	config, err = loadConfig(dir + "/missing")
+	if err != nil || len(config.Networks) != 0 {
+		t.Error("Missing config should be empty. Got", config, err)
+	}
+}
+
+func TestNetworkConfig_passwordCommand(t *testing.T) {
+
+	// Runs in a shell, so pipes and quotes work
+	netConf := &NetworkConfig{Name: "test", Password: "$(printf '%s\\n' 'two words' | tr w W)"}
+	if got := netConf.password(); got != "tWo Words" {
+		t.Error("Expected tWo Words. Got", got)
+	}
+
+	netConf.Password = "$(exit 1)"
+	if got := netConf.password(); got != "" {
+		t.Error("Failed command should give no password. Got", got)
+	}
+}
+
+func TestExternalManager_connectByName(t *testing.T) {
+
+	defer useTempLogdir(t)()
+
+	conn := newFakeConn()
+	dialed := make(chan string, 1)
+	defer func() { dial = sock }()
+	dial = func(network string) (net.Conn, error) {
+		dialed <- network
+		return conn, nil
+	}
+
+	config := NewConfig()
+	config.Networks["example"] = &NetworkConfig{
+		Name:     "example",
+		Address:  "irc.example.com:6697",
+		Nick:     "hatcog_user",
+		RealName: "Hatcog User",
+	}
+	manager := NewExternalManager(make(chan *Line, 10), config)
+	manager.Connect("example")
+	defer manager.Shutdown("", 100*time.Millisecond)
+
+	// Consume dials, so Connect doesn't wait for the network
+	if got := <-dialed; got != "irc.example.com:6697" {
+		t.Error("Should connect to the configured address. Got", got)
+	}
+	if networks := manager.Networks(); len(networks) != 1 || networks[0] != "example" {
+		t.Error("Network should be known by name. Got", networks)
+	}
+	for _, expected := range []string{"CAP LS 302\n", "NICK hatcog_user\n", "USER hatcog_user 0 * :Hatcog User\n"} {
+		if got := <-conn.written; got != expected {
+			t.Error("Expected", expected, "Got", got)
+		}
+	}
+}
+
+// The password command only runs for a new connection
+func TestExternalManager_connectRunsPasswordOnce(t *testing.T) {
+
+	defer useTempLogdir(t)()
+
+	defer func() { dial = sock }()
+	dial = func(network string) (net.Conn, error) {
+		return newFakeConn(), nil
+	}
+
+	runs, err := ioutil.TempFile("", "hatcogd-runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs.Close()
+	defer os.Remove(runs.Name())
+
+	config := NewConfig()
+	config.Networks["example"] = &NetworkConfig{
+		Name:     "example",
+		Address:  "irc.example.com:6697",
+		Nick:     "hatcog_user",
+		Password: "$(echo run >> " + runs.Name() + "; echo s3cret)",
+	}
+	manager := NewExternalManager(make(chan *Line, 10), config)
+	defer manager.Shutdown("", 100*time.Millisecond)
+
+	manager.Connect("example")
+	manager.Connect("example")
+
+	if got, _ := ioutil.ReadFile(runs.Name()); string(got) != "run\n" {
+		t.Error("Password command should run once. Got", string(got))
+	}
+}
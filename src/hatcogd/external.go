@@ -3,15 +3,43 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 )
 
+var (
+	ENOTCONNECTED = errors.New("Not connected")
+	ENONETWORK    = errors.New("No such network")
+	EQUITTIMEOUT  = errors.New("Server didn't close the connection after QUIT")
+)
+
 const (
 	ONE_SECOND_NS = 1000 * 1000 * 1000 // One second in nanoseconds
+
+	RECONNECT_MIN_NS     = ONE_SECOND_NS
+	RECONNECT_MAX_NS     = 5 * 60 * ONE_SECOND_NS
+	STABLE_CONNECTION_NS = 60 * ONE_SECOND_NS // Connected this long resets backoff
+	QUIT_WAIT_NS         = 5 * ONE_SECOND_NS  // How long the server gets to close after our QUIT
+	DIAL_TIMEOUT_NS      = 30 * ONE_SECOND_NS // How long each connection attempt gets
+
+	STATE_CONNECTED    = "connected"
+	STATE_DISCONNECTED = "disconnected"
+	STATE_RECONNECTING = "reconnecting"
+	STATE_CLOSED       = "closed" // We disconnected, and won't reconnect
+
+	ERR_NICKNAMEINUSE   = "433"
+	ERR_UNAVAILRESOURCE = "437" // Nick is held after a netsplit
+	MAX_NICK_RETRIES    = 3     // Most underscores we add to a nick in use
 )
 
 /*******************
@@ -19,61 +47,189 @@ const (
  *******************/
 
 type ExternalManager struct {
-	connections map[string]*External
+	lock        sync.Mutex           // Guards connections and config
+	connections map[string]*External // By network name
+	config      *Config
 	fromServer  chan *Line
 }
 
-func NewExternalManager(fromServer chan *Line) *ExternalManager {
-	return &ExternalManager{make(map[string]*External), fromServer}
+func NewExternalManager(fromServer chan *Line, config *Config) *ExternalManager {
+	return &ExternalManager{
+		connections: make(map[string]*External),
+		config:      config,
+		fromServer:  fromServer}
 }
 
-func (self *ExternalManager) Connect(addr string) {
+// Connect to a network. 'network' is the name of one in the config file,
+// which we register with it's nick and password, or an address
+// (host:port[:password]) for the client to register with.
+func (self *ExternalManager) Connect(network string) {
 
-	server, pass := splitNetPass(addr)
+	self.lock.Lock()
+	netConf := self.config.Networks[network]
+	if netConf == nil {
+		server, pass := splitNetPass(network)
+		netConf = &NetworkConfig{Name: server, Address: server, ServerPass: pass}
+	}
+	isConnected := self.connections[netConf.Name] != nil
+	self.lock.Unlock()
 
-	if self.connections[server] == nil {
-		self.connections[server] = NewExternal(server, pass, self.fromServer)
-		go self.connections[server].Consume()
+	if isConnected {
+		return
 	}
+
+	// Might run a command, so not holding the lock
+	password := netConf.password()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// Another client may have connected while we ran it
+	if self.connections[netConf.Name] == nil {
+		self.connections[netConf.Name] = NewExternal(netConf, password, self.fromServer)
+		go self.connections[netConf.Name].Consume()
+	}
+}
+
+// Names of the networks in the config file, sorted
+func (self *ExternalManager) Configured() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.config.Names()
 }
 
-func (self *ExternalManager) Identify(network, password string) {
+// The External for a network, or nil
+func (self *ExternalManager) get(network string) *External {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	ext := self.connections[network]
 	if ext == nil {
 		log.Println("Error: no network for ", network)
-		return
 	}
-	ext.Identify(password)
+	return ext
 }
 
-func (self *ExternalManager) SendMessage(network, channel, msg string) {
+// Names of the networks we have, sorted
+func (self *ExternalManager) Networks() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	names := make([]string, 0, len(self.connections))
+	for name := range self.connections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (self *ExternalManager) Identify(network, password string) error {
+	if ext := self.get(network); ext != nil {
+		ext.Identify(password)
+		return nil
+	}
+	return ENONETWORK
+}
+
+func (self *ExternalManager) SendMessage(network, channel, msg string) error {
+	if ext := self.get(network); ext != nil {
+		return ext.SendMessage(channel, msg)
+	}
+	return ENONETWORK
+}
+
+func (self *ExternalManager) SendAction(network, channel, msg string) error {
+	if ext := self.get(network); ext != nil {
+		return ext.SendAction(channel, msg)
+	}
+	return ENONETWORK
+}
+
+// Say goodbye to a network, and forget it, so it can be connected again
+// later with different settings. Returns false if we don't have that network.
+func (self *ExternalManager) Disconnect(network, msg string) bool {
+
+	self.lock.Lock()
 	ext := self.connections[network]
+	delete(self.connections, network)
+	self.lock.Unlock()
+
 	if ext == nil {
-		log.Println("Error: no network for ", network)
-		return
+		return false
 	}
-	ext.SendMessage(channel, msg)
+	ext.Disconnect(msg)
+	return true
 }
 
-func (self *ExternalManager) SendAction(network, channel, msg string) {
+// Disconnect every network, and wait up to 'timeout' for them all to
+// close. Any still open after that are closed without waiting.
+func (self *ExternalManager) Shutdown(msg string, timeout time.Duration) {
+
+	self.lock.Lock()
+	connections := self.connections
+	self.connections = make(map[string]*External)
+	self.lock.Unlock()
+
+	for _, ext := range connections {
+		ext.Disconnect(msg)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for network, ext := range connections {
+		if !ext.Wait(time.Until(deadline)) {
+			log.Println("Gave up waiting for", network, "to close")
+			ext.Close()
+		}
+	}
+}
+
+// Is 'name' a channel on 'network', rather than a nick. If we don't
+// have that network, use the RFC 1459 rules.
+func (self *ExternalManager) IsChannel(network, name string) bool {
+
+	self.lock.Lock()
 	ext := self.connections[network]
+	self.lock.Unlock()
+
 	if ext == nil {
-		log.Println("Error: no network for ", network)
-		return
+		return NewISupport().IsChannel(name)
 	}
-	ext.SendAction(channel, msg)
+	return ext.IsChannel(name)
 }
 
-func (self *ExternalManager) doCommand(network, content string) {
+// CASEMAPPING of 'network', or the RFC 1459 default if we don't have it
+func (self *ExternalManager) CaseMapping(network string) string {
+
+	self.lock.Lock()
 	ext := self.connections[network]
+	self.lock.Unlock()
+
 	if ext == nil {
-		log.Println("Error: no network for ", network)
-		return
+		return CASEMAPPING_RFC1459
 	}
-	ext.doCommand(content)
+	return ext.CaseMapping()
+}
+
+// Snapshot of 'channel' on 'network', or nil if we're not in it
+func (self *ExternalManager) ChannelSnapshot(network, channel string) *ChannelSnapshot {
+	if ext := self.get(network); ext != nil {
+		return ext.ChannelSnapshot(channel)
+	}
+	return nil
+}
+
+func (self *ExternalManager) doCommand(network, content string) error {
+	if ext := self.get(network); ext != nil {
+		return ext.doCommand(content)
+	}
+	return ENONETWORK
 }
 
 func (self *ExternalManager) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	for _, conn := range self.connections {
 		conn.Close()
 	}
@@ -85,16 +241,45 @@ func (self *ExternalManager) Close() error {
  * External *
  ************/
 
+// The Consume goroutine reads from the socket, everything else is called from
+// the Server goroutine. 'lock' guards all the fields below it.
 type External struct {
-	network      string
-	pass         string
+	network    string // Name from the config file, or address if it's not in there
+	addr       string // host:port
+	pass       string
+	fromServer chan *Line
+	rawLog     *log.Logger
+	rawLogFile *os.File      // Where rawLog writes, see reopenRawLog
+	stop       chan struct{} // Closed by Disconnect
+	done       chan struct{} // Closed when Consume returns
+
+	lock         sync.Mutex
+	toClients    []*Line // Lines waiting to go to fromServer, see emit
 	socket       net.Conn
-	fromServer   chan *Line
-	rawLog       *log.Logger
 	isIdentified bool
+	caps         *Capabilities
+	isupport     *ISupport // From the server's RPL_ISUPPORT lines
+	sasl         Sasl
+	nick         string                   // Most recent nick the client asked for
+	wantedNick   string                   // Nick to take back after registering as nick_, see onNickInUse
+	isReregister bool                     // We sent NICK and USER, not the client
+	password     string                   // NickServ / SASL password, from /pw
+	isUserSent   bool                     // Client sent USER, registration can complete
+	isRegistered bool                     // Received RPL_WELCOME
+	userCmd      string                   // USER command the client registered with, to re-use on reconnect
+	channels     map[string]string        // Channels we are in, to rejoin on reconnect. Value is the key.
+	chanStates   map[string]*ChannelState // Channels we are in, by folded name
+	keys         map[string]string        // Keys for channels we asked to JOIN
+	connectedAt  time.Time                // When the socket opened
+	lagSent      time.Time                // When we sent our last lag PING, see checkLag
+	lag          time.Duration            // Round trip of our last lag PING
+	quitAt       time.Time                // When Disconnect sent QUIT, zero if it hasn't
 }
 
-func NewExternal(server string, pass string, fromServer chan *Line) *External {
+// Connection to the network in 'netConf'. If that has a nick we register
+// ourselves, otherwise we wait for a client to do it. 'password' is
+// netConf's, already resolved. Doesn't connect, Consume does that.
+func NewExternal(netConf *NetworkConfig, password string, fromServer chan *Line) *External {
 
 	logFilename := *logdir + "/server_raw.log"
 	logFile := openLogFile(logFilename)
@@ -102,137 +287,506 @@ func NewExternal(server string, pass string, fromServer chan *Line) *External {
 	log.Println("Logging raw IRC messages to:", logFilename)
 
 	conn := &External{
-		network:    server,
-		pass:       pass,
+		network:    netConf.Name,
+		addr:       netConf.Address,
+		pass:       netConf.ServerPass,
 		fromServer: fromServer,
 		rawLog:     rawLog,
+		rawLogFile: logFile,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		caps:       NewCapabilities(),
+		isupport:   NewISupport(),
+		channels:   make(map[string]string),
+		chanStates: make(map[string]*ChannelState),
+		keys:       make(map[string]string),
+	}
+
+	if netConf.Nick != "" {
+		conn.nick = netConf.Nick
+		conn.userCmd = netConf.userCmd()
+		conn.password = password
 	}
-	conn.connect()
 
 	return conn
 }
 
-func (self *External) connect() {
-
-	var err error
+// Open the socket and start registration
+func (self *External) connect() error {
 
-	self.socket, err = sock(self.network, 5)
+	socket, err := dial(self.addr)
 	if err != nil {
-		log.Fatal("Error connecting to IRC server: ", err)
+		return err
 	}
 
 	time.Sleep(ONE_SECOND_NS)
 
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.socket = socket
+	self.connectedAt = time.Now()
+	self.lagSent = time.Time{}
+	self.lag = 0
+	self.sasl = Sasl{}
+	self.isupport = NewISupport() // Might be a different server
+	self.chanStates = make(map[string]*ChannelState)
+	self.isUserSent = false
+	self.isRegistered = false
+	self.isReregister = false
+	if self.wantedNick != "" {
+		// Lost the connection before we got our nick back
+		self.nick = self.wantedNick
+		self.wantedNick = ""
+	}
+	self.isIdentified = false
+
 	if self.pass != "" {
-		self.SendRaw("PASS " + self.pass)
+		self.sendRaw("PASS " + self.pass)
 	}
+	self.startCap()
+	self.reregister()
+
+	return nil
 }
 
+// Register with the nick and user details from the config file, or after a
+// reconnect the ones the client gave us last time. Identify and rejoin
+// happen on RPL_WELCOME.
+func (self *External) reregister() {
+
+	if self.nick == "" || self.userCmd == "" {
+		// First connection, client registers itself
+		return
+	}
+
+	log.Println("Registering on", self.network, "as", self.nick)
+	self.sendRaw("NICK " + self.nick)
+	self.sendRaw(self.userCmd)
+	self.isUserSent = true
+	self.isReregister = true
+	self.maybeStartSasl()
+}
+
+// Our nick is taken while we register, usually by our old connection that
+// hasn't timed out yet. Register as nick_, and ask for the nick back on
+// RPL_WELCOME. Call with lock held.
+func (self *External) onNickInUse() {
+
+	if self.wantedNick == "" {
+		self.wantedNick = self.nick
+	}
+	if len(self.nick)-len(self.wantedNick) >= MAX_NICK_RETRIES {
+		log.Println("Giving up on a nick for", self.network, "last tried", self.nick)
+		return
+	}
+
+	self.nick += "_"
+	log.Println("Nick in use on", self.network, "trying", self.nick)
+	self.sendRaw("NICK " + self.nick)
+}
+
+// Join all the channels we were in before we lost the connection
+func (self *External) rejoin() {
+	for channel, key := range self.channels {
+		log.Println("Rejoining", channel, "on", self.network)
+		if key != "" {
+			self.sendRaw("JOIN " + channel + " " + key)
+		} else {
+			self.sendRaw("JOIN " + channel)
+		}
+	}
+}
+
+// Keep track of which channels we are in, so we can rejoin them
+func (self *External) trackChannels(line *Line) {
+
+	switch line.Command {
+
+	case "JOIN":
+		if self.isMe(line.User) {
+			self.forgetChannel(line.Channel) // In case we had it in another case
+			self.channels[line.Channel] = self.keys[self.fold(line.Channel)]
+		}
+
+	case "PART":
+		if self.isMe(line.User) {
+			self.forgetChannel(line.Channel)
+		}
+
+	case "KICK":
+		if len(line.Args) > 1 && self.isMe(line.Args[1]) {
+			self.forgetChannel(line.Channel)
+		}
+
+	case "NICK":
+		// Server may change our nick, or confirm a change we asked for
+		if self.isMe(line.User) && line.Content != "" {
+			self.nick = line.Content
+			line.IsOurNick = true
+		}
+	}
+}
+
+// We're not in 'channel' any more. Call with lock held.
+func (self *External) forgetChannel(channel string) {
+	for name := range self.channels {
+		if self.fold(name) == self.fold(channel) {
+			delete(self.channels, name)
+		}
+	}
+}
+
+// A nick or channel in the server's casemapping. Call with lock held.
+func (self *External) fold(name string) string {
+	return foldCase(self.isupport.CaseMapping(), name)
+}
+
+// Is 'nick' us. Call with lock held.
+func (self *External) isMe(nick string) bool {
+	return nick != "" && self.fold(nick) == self.fold(self.nick)
+}
+
+// The server's CASEMAPPING
+func (self *External) CaseMapping() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.isupport.CaseMapping()
+}
+
+// Remember the keys in an outgoing JOIN command: "JOIN #a,#b keyA,keyB"
+func (self *External) recordKeys(args string) {
+
+	parts := strings.Fields(args)
+	if len(parts) < 2 {
+		return
+	}
+
+	channels := strings.Split(parts[0], ",")
+	keys := strings.Split(parts[1], ",")
+	for index, channel := range channels {
+		if index < len(keys) {
+			self.keys[self.fold(channel)] = keys[index]
+		}
+	}
+}
+
+// Opens connections to IRC servers. Tests replace this.
+var dial = sock
+
 /* A socket connection to give network (ip:port). */
-func sock(network string, tries int) (net.Conn, error) {
+func sock(network string) (net.Conn, error) {
 
 	var socket net.Conn
 	var err error
+	dialer := &net.Dialer{Timeout: DIAL_TIMEOUT_NS}
 
-	for tries > 0 {
+	socket, err = tls.DialWithDialer(dialer, "tcp", network, tlsConfig()) // Always try TLS first
+	if err == nil {
+		log.Println("Secure TLS connection to", network)
+		return socket, nil
+	}
 
-		socket, err = tls.Dial("tcp", network, nil) // Always try TLS first
-		if err == nil {
-			log.Println("Secure TLS connection to", network)
-			return socket, nil
-		}
+	socket, err = dialer.Dial("tcp", network)
+	if err == nil {
+		log.Println("Insecure connection to", network)
+		return socket, nil
+	}
 
-		socket, err = net.Dial("tcp", network)
-		if err == nil {
-			log.Println("Insecure connection to", network)
-			return socket, nil
-		}
+	log.Println("Connection attempt failed:", err)
+	return nil, err
+}
 
-		log.Println("Connection attempt failed:", err)
-		time.Sleep(ONE_SECOND_NS)
+// TLS settings for IRC connections. Includes our client certificate, if we have one.
+func tlsConfig() *tls.Config {
 
-		tries--
+	if !hasClientCert() {
+		return nil
 	}
 
-	return socket, err
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		log.Println("Error loading TLS client certificate:", err)
+		return nil
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
 }
 
-// Identify with NickServ. Must of already sent NICK.
+// Was hatcogd given a TLS client certificate, for SASL EXTERNAL
+func hasClientCert() bool {
+	return *certFile != "" && *keyFile != ""
+}
+
+// Did we show the server our client certificate. If TLS failed and we fell
+// back to plain text, we didn't. Call with lock held.
+func (self *External) isCertPresented() bool {
+	_, isTLS := self.socket.(*tls.Conn)
+	return isTLS && tlsConfig() != nil
+}
+
+// Identify with the password. While registering we use SASL if the server
+// supports it. Otherwise we identify with NickServ once registered.
 func (self *External) Identify(password string) {
-	if !self.isIdentified {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.isIdentified {
+		return
+	}
+	self.password = password
+
+	if !self.isRegistered {
+		self.maybeStartSasl()
+		return
+	}
+	self.identifyNickServ()
+}
+
+// Identify with NickServ. Must of already sent NICK.
+func (self *External) identifyNickServ() {
+	if !self.isIdentified && self.password != "" {
 		log.Println("Identifying with NickServ")
-		self.SendMessage("NickServ", "identify "+password)
+		self.sendRaw("PRIVMSG NickServ :identify " + self.password)
 		self.isIdentified = true
 	}
 }
 
 // Send a regular (non-system command) IRC message
-func (self *External) SendMessage(channel, msg string) {
+func (self *External) SendMessage(channel, msg string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	fullmsg := "PRIVMSG " + channel + " :" + msg
-	self.SendRaw(fullmsg)
+	return self.sendRaw(fullmsg)
 }
 
 // Send a /me action message
-func (self *External) SendAction(channel, msg string) {
+func (self *External) SendAction(channel, msg string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	fullmsg := "PRIVMSG " + channel + " :\u0001ACTION " + msg + "\u0001"
-	self.SendRaw(fullmsg)
+	return self.sendRaw(fullmsg)
 }
 
 // Send message down socket. Add \n at end first.
-func (self *External) SendRaw(msg string) {
+func (self *External) SendRaw(msg string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.sendRaw(msg)
+}
+
+// SendRaw with lock held.
+// If the write fails we close the socket, and Consume reconnects.
+func (self *External) sendRaw(msg string) error {
 
 	var err error
 	msg = msg + "\n"
 
+	if self.socket == nil {
+		log.Println("Not connected to", self.network, "dropping:", msg)
+		return ENOTCONNECTED
+	}
+
 	self.rawLog.Print(" -->", msg)
 
 	_, err = self.socket.Write([]byte(msg))
-	if err == io.EOF {
-		log.Println("SendRaw: IRC server closed connection.")
-		self.Close()
-	} else if err != nil {
-		log.Fatal("Error writing to socket: ", err)
+	if err != nil {
+		if err == io.EOF {
+			log.Println("SendRaw: IRC server closed connection.")
+		} else {
+			log.Println("Error writing to socket:", err)
+		}
+		self.closeSocket()
 	}
+	return err
 }
 
 // Process a slash command
-func (self *External) doCommand(content string) {
+func (self *External) doCommand(content string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 
 	content = content[1:]
-	self.SendRaw(content)
+	err := self.sendRaw(content)
+
+	parts := strings.SplitN(content, " ", 2)
+	switch strings.ToUpper(parts[0]) {
+
+	case "NICK":
+		// Once we're registered the server has to agree, see trackChannels
+		if len(parts) == 2 && !self.isRegistered {
+			self.nick = strings.TrimSpace(parts[1])
+		}
+
+	case "USER":
+		// Client has done it's part of registration
+		self.userCmd = content
+		self.isUserSent = true
+		self.maybeStartSasl()
+
+	case "JOIN":
+		if len(parts) == 2 {
+			self.recordKeys(parts[1])
+		}
+	}
+	return err
 }
 
-// Read IRC messages from the connection and act on them
+// Connect, read IRC messages from the connection and act on them.
+// If the connection fails, reconnect with exponential backoff. This only
+// returns after Disconnect, and never affects other networks.
 func (self *External) Consume() {
 	defer logPanic()
+	defer close(self.done)
+
+	var err error
+	attempt := 0
+	isFirst := true // First connection doesn't wait
+
+	for {
+
+		if !self.isConnected() && !isFirst {
+			delay := reconnectDelay(attempt)
+			attempt++
+
+			log.Println("Reconnecting to", self.network, "in", delay)
+			self.sendState(
+				STATE_RECONNECTING,
+				fmt.Sprintf("Reconnecting to %s in %ds", self.network, int(delay.Seconds())))
+
+			select {
+			case <-time.After(delay):
+			case <-self.stop:
+			}
+		}
+		isFirst = false
+
+		if !self.isConnected() {
+			if self.isStopped() {
+				break
+			}
+
+			err = self.connect()
+			if err != nil {
+				log.Println("Error connecting to IRC server:", err)
+				continue
+			}
+		}
+		if self.isStopped() {
+			// Disconnected while we were connecting
+			break
+		}
+
+		self.sendState(STATE_CONNECTED, "Connected to "+self.network)
+		connectedAt := time.Now()
+
+		err = self.read()
+		log.Println("Connection to", self.network, "lost:", err)
+
+		self.Close()
+		if self.isStopped() {
+			break
+		}
+		self.sendState(STATE_DISCONNECTED, "Disconnected from "+self.network)
+
+		if time.Since(connectedAt) > STABLE_CONNECTION_NS {
+			attempt = 0
+		}
+	}
+
+	self.Close()
+	log.Println("Disconnected from", self.network)
+	self.sendState(STATE_CLOSED, "Disconnected from "+self.network)
+}
+
+// Send QUIT, and stop Consume once the server closes the connection, or
+// after QUIT_WAIT_NS. Doesn't wait for Consume, see Wait.
+func (self *External) Disconnect(msg string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.isStopped() {
+		return
+	}
+
+	log.Println("Disconnecting from", self.network)
+	if msg == "" {
+		msg = *quitMsg
+	}
+	self.sendRaw("QUIT :" + msg)
+	self.quitAt = time.Now()
+	close(self.stop)
+}
+
+// Wait up to 'timeout' for Consume to return. Returns false if it didn't.
+func (self *External) Wait(timeout time.Duration) bool {
+	select {
+	case <-self.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Has Disconnect been called
+func (self *External) isStopped() bool {
+	select {
+	case <-self.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Did we QUIT more than QUIT_WAIT_NS ago. Call with lock held.
+func (self *External) isQuitExpired() bool {
+	return !self.quitAt.IsZero() && time.Since(self.quitAt) > QUIT_WAIT_NS
+}
+
+// Read lines from the socket until it fails. Returns the error.
+func (self *External) read() error {
 
 	var contentData []byte
 	var content string
 	var err error
 
-	bufRead := bufio.NewReader(self.socket)
+	self.lock.Lock()
+	socket := self.socket
+	self.lock.Unlock()
+
+	if socket == nil {
+		return ENOTCONNECTED
+	}
+
+	bufRead := bufio.NewReader(socket)
 	for {
 
-		self.socket.SetReadDeadline(time.Now().Add(ONE_SECOND_NS))
+		// Every line, not only on timeouts, which a busy network never has
+		self.lock.Lock()
+		isExpired := self.isQuitExpired()
+		self.checkLag()
+		self.lock.Unlock()
+
+		if isExpired {
+			return EQUITTIMEOUT
+		}
+
+		socket.SetReadDeadline(time.Now().Add(ONE_SECOND_NS))
 		contentData, err = bufRead.ReadBytes('\n')
 
 		if err != nil {
 			netErr, ok := err.(net.Error)
 			if ok && netErr.Timeout() == true {
+				// Lines from the Server goroutine may be waiting
+				self.flush()
 				continue
 			} else if err == io.EOF {
 				log.Println("Consume: IRC server closed connection.")
-				self.Close()
-
-				// Reconnect
-				log.Println("Attempting to reconnect")
-				self.connect()
-				bufRead = bufio.NewReader(self.socket)
-				continue
-
-			} else {
-				log.Fatal("Consume Error:", err)
 			}
+			return err
 		}
 
 		if len(contentData) == 0 {
@@ -243,7 +797,7 @@ func (self *External) Consume() {
 
 		self.rawLog.Println(content)
 
-		line, err := ParseLine(content)
+		line, err := self.parse(content)
 		if err == nil {
 			line.Network = self.network
 			self.act(line)
@@ -254,6 +808,31 @@ func (self *External) Consume() {
 	}
 }
 
+// How long to wait before reconnect attempt number 'attempt' (from 0).
+// Doubles every attempt up to RECONNECT_MAX_NS. Jitter keeps us from
+// reconnecting in lock-step with every other client after a netsplit.
+func reconnectDelay(attempt int) time.Duration {
+
+	delay := time.Duration(RECONNECT_MIN_NS)
+	for i := 0; i < attempt && delay < RECONNECT_MAX_NS; i++ {
+		delay *= 2
+	}
+	if delay > RECONNECT_MAX_NS {
+		delay = RECONNECT_MAX_NS
+	}
+
+	// Somewhere between half and all of delay
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Tell clients on this network about our connection state
+func (self *External) sendState(state, msg string) {
+	line := NewLine(self.network, "STATE", msg)
+	line.Args = []string{state}
+	self.fromServer <- line
+}
+
 // Converts an array of bytes to a string
 // If the bytes are valid UTF-8, return those (as string),
 // otherwise assume we have ISO-8859-1 (latin1, and kinda windows-1252),
@@ -276,20 +855,140 @@ func toUnicode(data []byte) string {
 	return result
 }
 
-// Do something with a line
+// Queue a line for the clients. Call with lock held.
+// Lines go to fromServer in flush, without the lock, because the Server
+// goroutine may be waiting for our lock, and it is the one reading fromServer.
+func (self *External) emit(line *Line) {
+	self.toClients = append(self.toClients, line)
+}
+
+// Send queued lines to the clients. Call without lock held.
+func (self *External) flush() {
+
+	self.lock.Lock()
+	lines := self.toClients
+	self.toClients = nil
+	self.lock.Unlock()
+
+	for _, line := range lines {
+		self.fromServer <- line
+	}
+}
+
+// Parse a line from the server, using what it told us it supports
+func (self *External) parse(content string) (*Line, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return ParseLineWith(content, self.isupport)
+}
+
+// Is 'name' a channel on this network, rather than a nick
+func (self *External) IsChannel(name string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.isupport.IsChannel(name)
+}
+
+// Do something with a line from the server, then pass it on to the clients
 func (self *External) act(line *Line) {
 
-	if line.Command == "PING" {
+	self.lock.Lock()
+	self.handle(line)
+	self.lock.Unlock()
+
+	self.flush()
+}
+
+// Update our state from a line, and reply if needed. Call with lock held.
+func (self *External) handle(line *Line) {
+
+	if self.caps.Has("server-time") {
+		line.useServerTime()
+	}
+
+	if line.Command == "CAP" {
+		// Negotiation is internal, clients get a CAPS line when it's done
+		self.onCap(line)
+		return
+
+	} else if line.Command == "421" && len(line.Args) > 1 && line.Args[1] == "CAP" {
+		// Server doesn't support capabilities, it's registering us already
+		log.Println("No capability negotiation on", self.network)
+		self.caps.isNegotiating = false
+
+	} else if line.Command == "AUTHENTICATE" {
+		self.onAuthenticate(line)
+		return
+
+	} else if isSaslResult(line.Command) {
+		self.onSaslResult(line)
+
+	} else if line.Command == "001" {
+		// RPL_WELCOME, registration complete
+		self.isRegistered = true
+		self.caps.isNegotiating = false
+		if len(line.Args) > 0 {
+			self.nick = line.Args[0] // Server tells us our nick
+		}
+		if self.wantedNick != "" && !self.isMe(self.wantedNick) {
+			// Server changes self.nick when it agrees, see trackChannels
+			self.sendRaw("NICK " + self.wantedNick)
+		}
+		self.wantedNick = ""
+		self.identifyNickServ()
+		self.rejoin()
+
+	} else if (line.Command == ERR_NICKNAMEINUSE || line.Command == ERR_UNAVAILRESOURCE) &&
+		!self.isRegistered && self.isReregister {
+		self.onNickInUse()
+
+	} else if line.Command == RPL_ISUPPORT && len(line.Args) > 1 {
+		// First arg is our nick
+		self.isupport.Update(line.Args[1:])
+
+	} else if line.Command == "JOIN" || line.Command == "PART" ||
+		line.Command == "KICK" || line.Command == "NICK" {
+		self.trackChannels(line)
+
+	} else if self.onLagPong(line) {
+		// Our own PING, clients don't need to see it
+		return
+
+	} else if line.Command == "PING" {
 		// Reply, and send message on to client
-		self.SendRaw("PONG " + line.Content)
+		self.sendRaw("PONG " + line.Content)
 	} else if line.Command == "VERSION" {
 		versionMsg := "NOTICE " + line.User + " :\u0001VERSION " + VERSION + "\u0001\n"
-		self.SendRaw(versionMsg)
+		self.sendRaw(versionMsg)
 	}
 
-	self.fromServer <- line
+	self.updateChannelState(line)
+	self.emit(line)
+}
+
+// Is our socket open
+func (self *External) isConnected() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.socket != nil
 }
 
 func (self *External) Close() error {
-	return self.socket.Close()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.closeSocket()
+}
+
+// Close with lock held
+func (self *External) closeSocket() error {
+	if self.socket == nil {
+		return nil
+	}
+	err := self.socket.Close()
+	self.socket = nil
+	return err
 }
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestParseLine_welcome(t *testing.T) {
@@ -131,3 +140,883 @@ func testSplitNetPass_noPass(t *testing.T) {
 		t.Error("Password part incorrect. Got: ", p1)
 	}
 }
+
+func TestParseLine_tags(t *testing.T) {
+	line1 := "@time=2012-06-30T23:59:59.419Z;+example.com/typing=active;msgid=abc :alan!223@irc.andbang.com PRIVMSG #ll :hello"
+	line, err := ParseLine(line1)
+
+	if err != nil {
+		t.Error("ParseLine error: ", err)
+	}
+
+	if line.Command != "PRIVMSG" {
+		t.Error("Command incorrect. Got", line.Command)
+	}
+	if line.User != "alan" {
+		t.Error("User incorrect. Got", line.User)
+	}
+	if line.Channel != "#ll" {
+		t.Error("Channel incorrect. Got", line.Channel)
+	}
+	if line.Tags["time"] != "2012-06-30T23:59:59.419Z" {
+		t.Error("time tag incorrect. Got", line.Tags)
+	}
+	if line.Tags["+example.com/typing"] != "active" {
+		t.Error("Client-only tag incorrect. Got", line.Tags)
+	}
+	if line.Tags["msgid"] != "abc" {
+		t.Error("msgid tag incorrect. Got", line.Tags)
+	}
+}
+
+func TestParseLine_tagsEscaped(t *testing.T) {
+	line1 := `@a=one\:two\sthree\\four;b;c= :irc.example.com NOTICE * :hi`
+	line, err := ParseLine(line1)
+
+	if err != nil {
+		t.Error("ParseLine error: ", err)
+	}
+
+	if line.Tags["a"] != `one;two three\four` {
+		t.Error("Escaped tag incorrect. Got", line.Tags["a"])
+	}
+	if val, ok := line.Tags["b"]; !ok || val != "" {
+		t.Error("Tag without value incorrect. Got", line.Tags)
+	}
+	if val, ok := line.Tags["c"]; !ok || val != "" {
+		t.Error("Tag with empty value incorrect. Got", line.Tags)
+	}
+	if line.Host != "irc.example.com" {
+		t.Error("Host incorrect. Got", line.Host)
+	}
+}
+
+func TestParseLine_noTags(t *testing.T) {
+	line1 := ":rnowak!~rnowak@q.ovron.com PRIVMSG #linode :totally"
+	line, _ := ParseLine(line1)
+
+	if line.Tags != nil {
+		t.Error("Tags should be nil. Got", line.Tags)
+	}
+}
+
+func TestParseLine_tagsOnly(t *testing.T) {
+	_, err := ParseLine("@a=b ")
+	if err == nil {
+		t.Error("Expected error for line with only tags")
+	}
+}
+
+func TestLine_useServerTime(t *testing.T) {
+
+	line, _ := ParseLine("@time=2012-06-30T23:59:59.419Z :alan!223@irc.andbang.com PRIVMSG #ll :hello")
+	line.useServerTime()
+
+	received, err := time.Parse(time.RFC3339, line.Received)
+	if err != nil {
+		t.Fatal("Received is not RFC3339. Got", line.Received)
+	}
+	expected := time.Date(2012, 6, 30, 23, 59, 59, 0, time.UTC)
+	if !received.Equal(expected) {
+		t.Error("Received incorrect. Got", line.Received)
+	}
+	if line.ReceivedLocal == line.Received {
+		t.Error("ReceivedLocal should keep the local time")
+	}
+	if line.Delay <= 0 {
+		t.Error("Delay should be positive. Got", line.Delay)
+	}
+}
+
+func TestLine_useServerTimeNoTag(t *testing.T) {
+
+	line, _ := ParseLine(":alan!223@irc.andbang.com PRIVMSG #ll :hello")
+	line.useServerTime()
+
+	if line.Received != line.ReceivedLocal || line.Delay != 0 {
+		t.Error("Received should be local time without a time tag. Got", line.Received)
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+
+	var previousMax time.Duration
+	for attempt := 0; attempt < 20; attempt++ {
+		delay := reconnectDelay(attempt)
+
+		max := time.Duration(RECONNECT_MIN_NS) << uint(attempt)
+		if max > RECONNECT_MAX_NS || max <= 0 {
+			max = RECONNECT_MAX_NS
+		}
+		if delay < max/2 || delay > max {
+			t.Error("Delay for attempt", attempt, "out of range. Got", delay)
+		}
+		if max < previousMax {
+			t.Error("Delay should never shrink")
+		}
+		previousMax = max
+	}
+}
+
+func TestExternal_sendRawNotConnected(t *testing.T) {
+
+	ext, _ := newTestExternal()
+	ext.socket = nil
+
+	// Must not panic or exit
+	ext.SendRaw("PRIVMSG #test :hello")
+}
+
+func TestExternal_rejoin(t *testing.T) {
+
+	ext, sent := newTestExternal()
+
+	ext.doCommand("/nick bob")
+	expectSent(t, sent, "nick bob")
+	ext.doCommand("/user bob 0 * Bob")
+	expectSent(t, sent, "user bob 0 * Bob")
+
+	ext.doCommand("/join #secret,#open s3cret")
+	expectSent(t, sent, "join #secret,#open s3cret")
+	serverSays(ext, ":bob!b@example.com JOIN #secret")
+	serverSays(ext, ":bob!b@example.com JOIN :#open")
+	serverSays(ext, ":bob!b@example.com JOIN #gone")
+	serverSays(ext, ":alice!a@example.com JOIN #other")
+	serverSays(ext, ":bob!b@example.com PART #gone :bye")
+	serverSays(ext, ":op!o@example.com JOIN #kicked")
+	serverSays(ext, ":bob!b@example.com JOIN #kicked")
+	serverSays(ext, ":op!o@example.com KICK #kicked bob :out")
+
+	if len(ext.channels) != 2 || ext.channels["#secret"] != "s3cret" || ext.channels["#open"] != "" {
+		t.Fatal("Tracked channels incorrect. Got", ext.channels)
+	}
+
+	// Connection lost and re-established
+	ext.isRegistered = false
+	ext.isUserSent = false
+	ext.reregister()
+	expectSent(t, sent, "NICK bob")
+	expectSent(t, sent, "user bob 0 * Bob")
+
+	serverSays(ext, ":irc.example.com 001 bob :Welcome")
+	rejoined := []string{<-sent, <-sent}
+	sort.Strings(rejoined)
+	if rejoined[0] != "JOIN #open" || rejoined[1] != "JOIN #secret s3cret" {
+		t.Error("Rejoin incorrect. Got", rejoined)
+	}
+}
+
+// Our old connection still has the nick when we reconnect
+func TestExternal_nickInUse(t *testing.T) {
+
+	ext, sent := newTestExternal()
+	ext.nick = "hatcog"
+	ext.userCmd = "USER hatcog 0 * :Hatcog"
+	ext.reregister()
+	expectSent(t, sent, "NICK hatcog")
+	expectSent(t, sent, "USER hatcog 0 * :Hatcog")
+
+	serverSays(ext, ":irc.example.com 433 * hatcog :Nickname is already in use")
+	expectSent(t, sent, "NICK hatcog_")
+	serverSays(ext, ":irc.example.com 437 * hatcog_ :Nick is temporarily unavailable")
+	expectSent(t, sent, "NICK hatcog__")
+
+	serverSays(ext, ":irc.example.com 001 hatcog__ :Welcome")
+	expectSent(t, sent, "NICK hatcog")
+	serverSays(ext, ":hatcog__!h@example.com NICK :hatcog")
+	if ext.nick != "hatcog" {
+		t.Error("Should have our nick back. Got", ext.nick)
+	}
+
+	// Once registered, it's up to the client
+	serverSays(ext, ":irc.example.com 433 hatcog robert :Nickname is already in use")
+	select {
+	case got := <-sent:
+		t.Error("Should only retry while registering. Sent", got)
+	default:
+	}
+}
+
+func TestExternal_writeFailure(t *testing.T) {
+
+	conn := newFakeConn()
+	conn.writeErr = errors.New("broken pipe")
+
+	ext, _ := newTestExternal()
+	ext.socket = conn
+
+	err := ext.SendRaw("PRIVMSG #test :hello")
+	if err == nil {
+		t.Error("SendRaw should return the write error")
+	}
+	if !conn.isClosed() {
+		t.Error("Failed socket should be closed, so Consume reconnects")
+	}
+}
+
+func TestExternal_readFailure(t *testing.T) {
+
+	conn := newFakeConn()
+	conn.readErr = errors.New("connection reset by peer")
+	conn.input <- "PING :irc.example.com\r\n"
+	close(conn.input)
+
+	ext, _ := newTestExternal()
+	ext.socket = conn
+
+	err := ext.read()
+	if err != conn.readErr {
+		t.Error("read should return the socket error. Got", err)
+	}
+	if got := <-conn.written; got != "PONG irc.example.com\n" {
+		t.Error("Lines before the failure should be processed. Sent", got)
+	}
+}
+
+func TestExternal_consumeReconnects(t *testing.T) {
+
+	first := newFakeConn()
+	close(first.input) // Server hangs up straight away
+	second := newFakeConn()
+
+	defer func() { dial = sock }()
+	dial = func(network string) (net.Conn, error) {
+		return second, nil
+	}
+
+	ext, _ := newTestExternal()
+	ext.socket = first
+	go ext.Consume()
+
+	for _, expected := range []string{STATE_CONNECTED, STATE_DISCONNECTED, STATE_RECONNECTING, STATE_CONNECTED} {
+		select {
+		case line := <-ext.fromServer:
+			if line.Command != "STATE" || line.Args[0] != expected {
+				t.Fatal("Expected state", expected, "Got", line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for state", expected)
+		}
+	}
+	if got := <-second.written; got != "CAP LS 302\n" {
+		t.Error("Reconnect should start registration. Sent", got)
+	}
+}
+
+// An unreachable network mustn't hold up the others while it connects
+func TestExternalManager_connectDoesNotBlock(t *testing.T) {
+
+	defer useTempLogdir(t)()
+
+	dialing := make(chan time.Time, 1)
+	unblock := make(chan struct{})
+	defer func() { dial = sock }()
+	dial = func(network string) (net.Conn, error) {
+		dialing <- time.Now()
+		<-unblock
+		return nil, errors.New("timeout")
+	}
+
+	manager := NewExternalManager(make(chan *Line, 10), NewConfig())
+	start := time.Now()
+	manager.Connect("irc.example.com:6697")
+
+	if manager.get("irc.example.com:6697") == nil {
+		t.Error("Connect should add the network straight away")
+	}
+	if dialed := <-dialing; dialed.Sub(start) > RECONNECT_MIN_NS/2 {
+		t.Error("First connection shouldn't wait. Waited", dialed.Sub(start))
+	}
+
+	close(unblock)
+	manager.Shutdown("", 100*time.Millisecond)
+}
+
+func TestInternal_writeFailure(t *testing.T) {
+
+	manager := NewInternalManager("", "", make(chan Message, 10))
+	internalConn, conn := newTestInternal(manager, "#test")
+	conn.writeErr = errors.New("broken pipe")
+	_, other := newTestInternal(manager, "#other")
+
+	done := make(chan bool)
+	go func() {
+		internalConn.Run()
+		done <- true
+	}()
+
+	manager.WriteAll("irc.example.com:6697", []byte("{}\n"))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Internal with failed write should stop")
+	}
+
+	if len(manager.connections) != 1 || manager.connections[0].netConn != other {
+		t.Error("Failed Internal should be dropped, others kept. Got", manager.connections)
+	}
+	if <-other.written != "{}\n" {
+		t.Error("Other Internal should still get the message")
+	}
+}
+
+func TestInternal_readFailure(t *testing.T) {
+
+	fromUser := make(chan Message, 10)
+	manager := NewInternalManager("", "", fromUser)
+	internalConn, conn := newTestInternal(manager, "#test")
+	conn.readErr = errors.New("connection reset by peer")
+	close(conn.input)
+
+	internalConn.Run()
+
+	if len(manager.connections) != 0 {
+		t.Error("Failed Internal should be dropped")
+	}
+	if msg := <-fromUser; msg.content != "/part #test" {
+		t.Error("Should part channel. Got", msg.content)
+	}
+}
+
+func TestInternalManager_acceptFailure(t *testing.T) {
+
+	listener := &fakeListener{make(chan error, 2)}
+	listener.errs <- errors.New("too many open files")
+	listener.errs <- net.ErrClosed
+
+	manager := NewInternalManager("", "", make(chan Message))
+	manager.listeners = []net.Listener{listener}
+
+	done := make(chan bool)
+	go func() {
+		manager.Run()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run should keep going after an Accept error, and return when closed")
+	}
+}
+
+// Clients come and go while server lines are written to them.
+// Run with -race.
+func TestInternalManager_concurrentClients(t *testing.T) {
+
+	defer useTempLogdir(t)()
+
+	fromUser := make(chan Message, 1000)
+	manager := NewInternalManager("127.0.0.1", "0", fromUser)
+	if err := manager.Listen(); err != nil {
+		t.Fatal("Listen error:", err)
+	}
+	defer manager.Close()
+	go manager.Run()
+
+	network := "irc.example.com:6697"
+	addr := manager.listeners[0].Addr().String()
+
+	stop := make(chan bool)
+	go func() {
+		msg := []byte("{}\n")
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			manager.WriteAll(network, msg)
+			manager.WriteChannel(network, "#test", msg)
+			manager.WriteFirst(network, msg)
+			manager.QueuePrivate(&Line{Network: network, Channel: "alice"})
+			manager.HasChannel(network, "#test")
+			manager.SetNick(network, "bob")
+		}
+	}()
+
+	var wait sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Error("Dial error:", err)
+				return
+			}
+			conn.Write([]byte("/auth " + manager.token + "\n"))
+			conn.Write([]byte("/connect " + network + "\n"))
+			if i%2 == 0 {
+				conn.Write([]byte("/join #test\n"))
+			} else {
+				conn.Write([]byte("/private alice\n"))
+			}
+			conn.Write([]byte("hello\n"))
+			time.Sleep(10 * time.Millisecond)
+			conn.Close()
+		}(i)
+	}
+	wait.Wait()
+	close(stop)
+
+	// Every client detaches itself
+	deadline := time.Now().Add(5 * time.Second)
+	for len(manager.find(func(*Internal) bool { return true })) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Clients not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Server traffic flows while the Server goroutine sends to the same External.
+// Run with -race.
+func TestExternal_concurrentSend(t *testing.T) {
+
+	conn := newFakeConn()
+	ext, _ := newTestExternal()
+	ext.socket = conn
+
+	go func() {
+		for range conn.written {
+		}
+	}()
+
+	done := make(chan bool)
+	go func() {
+		ext.read()
+		done <- true
+	}()
+
+	go func() {
+		for range ext.fromServer {
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		conn.input <- ":alice!a@example.com PRIVMSG #test :hello\r\n"
+		conn.input <- "PING :irc.example.com\r\n"
+		ext.SendMessage("#test", "hi")
+		ext.doCommand("/join #other")
+		ext.Identify("s3cret")
+	}
+	close(conn.input)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("read did not finish")
+	}
+}
+
+func TestInternalManager_delete(t *testing.T) {
+
+	fromUser := make(chan Message, 10)
+	manager := NewInternalManager("", "", fromUser)
+
+	first, firstConn := newTestInternal(manager, "#test")
+	second, secondConn := newTestInternal(manager, "#test")
+	other, _ := newTestInternal(manager, "#test")
+	other.network = "irc.oftc.net:6697"
+
+	if first.id == second.id || second.id == other.id {
+		t.Fatal("Internal ids should be unique")
+	}
+
+	close(firstConn.input)
+	first.Run()
+
+	if len(manager.connections) != 2 {
+		t.Fatal("Only the closed window should be removed. Got", len(manager.connections))
+	}
+	if !manager.HasChannel("irc.example.com:6697", "#test") {
+		t.Error("Second window should still be attached")
+	}
+	select {
+	case msg := <-fromUser:
+		t.Error("Should not part while another window is open. Got", msg.content)
+	default:
+	}
+
+	close(secondConn.input)
+	second.Run()
+
+	if len(manager.connections) != 1 || manager.connections[0] != other {
+		t.Error("Same channel on another network should stay attached")
+	}
+	msg := <-fromUser
+	if msg.content != "/part #test" || msg.network != "irc.example.com:6697" {
+		t.Error("Last window should part. Got", msg)
+	}
+}
+
+func TestInternal_detachMode(t *testing.T) {
+
+	defer func(previous bool) { *detach = previous }(*detach)
+	*detach = true
+	defer func(previous int) { *backlog = previous }(*backlog)
+	*backlog = 1
+
+	fromUser := make(chan Message, 10)
+	manager := NewInternalManager("", "", fromUser)
+	network := "irc.example.com:6697"
+
+	first, firstConn := newTestInternal(manager, "#test")
+	close(firstConn.input)
+	first.Run()
+
+	select {
+	case msg := <-fromUser:
+		t.Fatal("Should not part in detach mode. Got", msg.content)
+	default:
+	}
+
+	for _, content := range []string{"one", "two", "three"} {
+		line, _ := ParseLine(":alice!a@example.com PRIVMSG #test :" + content)
+		line.Network = network
+		manager.Record(line)
+	}
+
+	second, secondConn := newTestInternal(manager, "")
+	second.Special("/join #test")
+
+	if msg := <-fromUser; msg.content != "/names #test" {
+		t.Error("Reattach should ask for the user list. Got", msg.content)
+	}
+	for _, expected := range []string{"one", "two", "three"} {
+		var line Line
+		json.Unmarshal([]byte(<-secondConn.written), &line)
+		if line.Content != expected {
+			t.Error("Reattach should replay everything missed. Expected", expected, "Got", line.Content)
+		}
+	}
+
+	if !second.Special("/leave") {
+		t.Error("/leave is internal only")
+	}
+	if msg := <-fromUser; msg.content != "/part #test" {
+		t.Error("/leave should part. Got", msg.content)
+	}
+
+	// Client closes after /leave, we must not stay in #test
+	close(secondConn.input)
+	second.Run()
+	if _, isDetached := manager.detached[manager.key(network, "#test")]; isDetached {
+		t.Error("Closing after /leave should not detach")
+	}
+	select {
+	case msg := <-fromUser:
+		t.Error("Should part only once. Got", msg.content)
+	default:
+	}
+}
+
+func TestInternalManager_privateQueue(t *testing.T) {
+
+	manager := NewInternalManager("", "", make(chan Message, 10))
+	network := "irc.example.com:6697"
+
+	for i := 0; i < PRIVATE_QUEUE_SIZE+2; i++ {
+		line, _ := ParseLine(fmt.Sprintf(":alice!a@example.com PRIVMSG bob :%d", i))
+		line.Network = network
+		if manager.QueuePrivate(line) == 0 {
+			t.Fatal("Should queue with no window open")
+		}
+	}
+	line, _ := ParseLine(":carol!c@example.com PRIVMSG bob :hi")
+	line.Network = network
+	manager.QueuePrivate(line)
+
+	internalConn, conn := newTestInternal(manager, "")
+	if !internalConn.Special("/private alice") {
+		t.Error("/private is internal only")
+	}
+
+	var first Line
+	json.Unmarshal([]byte(<-conn.written), &first)
+	if first.Command != "NOTICE" || !strings.HasPrefix(first.Content, "2 earlier") {
+		t.Error("Expected overflow notice. Got", first)
+	}
+	for i := 2; i < PRIVATE_QUEUE_SIZE+2; i++ {
+		var line Line
+		json.Unmarshal([]byte(<-conn.written), &line)
+		if line.Content != strconv.Itoa(i) || line.User != "alice" {
+			t.Fatal("Expected queued message", i, "Got", line)
+		}
+	}
+	select {
+	case got := <-conn.written:
+		t.Error("Only alice's messages should go to her window. Got", got)
+	default:
+	}
+
+	line, _ = ParseLine(":alice!a@example.com PRIVMSG bob :window open")
+	line.Network = network
+	if manager.QueuePrivate(line) != 0 {
+		t.Error("Should not queue when a window is open")
+	}
+	if len(manager.takePrivate(network, "carol")) != 1 {
+		t.Error("carol's message should still be waiting")
+	}
+}
+
+func TestServer_privatePrompt(t *testing.T) {
+
+	manager := NewInternalManager("", "", make(chan Message, 10))
+	network := "irc.example.com:6697"
+	server := &Server{
+		internal: manager,
+		external: &ExternalManager{connections: map[string]*External{}, config: NewConfig()},
+	}
+	privmsg := func(nick, content string) {
+		line, _ := ParseLine(":" + nick + "!a@example.com PRIVMSG bob :" + content)
+		line.Network = network
+		server.onServer(line)
+	}
+	open := func(commands ...string) (*Internal, *fakeConn) {
+		internalConn, conn := newTestInternal(manager, "")
+		internalConn.network = ""
+		for _, command := range commands {
+			internalConn.Special(command)
+		}
+		return internalConn, conn
+	}
+	expectNothing := func(conn *fakeConn, msg string) {
+		select {
+		case got := <-conn.written:
+			t.Error(msg, "Got", got)
+		default:
+		}
+	}
+
+	// Nobody to ask, e.g. in detach mode with every window closed
+	privmsg("alice", "one")
+	privmsg("alice", "two")
+
+	first, firstConn := open("/connect "+network, "/join #test")
+	var prompt Line
+	json.Unmarshal([]byte(<-firstConn.written), &prompt)
+	if prompt.Channel != "alice" || prompt.Content != "two" {
+		t.Error("Window opening should be asked to open alice's window. Got", prompt)
+	}
+
+	privmsg("alice", "three")
+	expectNothing(firstConn, "Should only ask once.")
+	_, otherConn := open("/connect "+network, "/join #other")
+	expectNothing(otherConn, "Already asked a window that's still open.")
+
+	// The window we asked opens alice's window
+	_, privateConn := open("/connect "+network, "/private alice")
+	for _, expected := range []string{"one", "two", "three"} {
+		var line Line
+		json.Unmarshal([]byte(<-privateConn.written), &line)
+		if line.Content != expected {
+			t.Error("Expected", expected, "Got", line.Content)
+		}
+	}
+	expectNothing(privateConn, "Each message should arrive once.")
+
+	// The window we asked closes without opening one, ask the next
+	privmsg("carol", "hello")
+	json.Unmarshal([]byte(<-firstConn.written), &prompt)
+	if prompt.Channel != "carol" {
+		t.Error("Should ask for carol's window. Got", prompt)
+	}
+	manager.delete(first)
+	_, lateConn := open("/connect "+network, "/join #late")
+	json.Unmarshal([]byte(<-lateConn.written), &prompt)
+	if prompt.Channel != "carol" || prompt.Content != "hello" {
+		t.Error("Should ask again when the window we asked closes. Got", prompt)
+	}
+}
+
+func TestInternalManager_listenUnix(t *testing.T) {
+
+	defer useTempLogdir(t)()
+	defer func(previous string) { *listenOn = previous }(*listenOn)
+	*listenOn = "unix"
+
+	manager := NewInternalManager("127.0.0.1", "0", make(chan Message, 10))
+	if err := manager.Listen(); err != nil {
+		t.Fatal("Listen error:", err)
+	}
+	defer manager.Close()
+	go manager.Run()
+
+	if len(manager.listeners) != 1 {
+		t.Error("Should only listen on the Unix socket. Got", manager.listeners)
+	}
+
+	info, err := os.Stat(socketPath())
+	if err != nil {
+		t.Fatal("Socket not created:", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Error("Socket should be 0600. Got", info.Mode().Perm())
+	}
+
+	conn, err := net.Dial("unix", socketPath())
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	conn.Write([]byte("/auth " + manager.token + "\n/connect irc.example.com:6697\n/join #test\n"))
+	conn.Close()
+
+	<-manager.fromUser // connect
+	if msg := <-manager.fromUser; msg.content != "/join #test" {
+		t.Error("Unix socket client should be served. Got", msg)
+	}
+}
+
+func TestExternal_disconnect(t *testing.T) {
+
+	conn := newFakeConn()
+	ext, _ := newTestExternal()
+	ext.socket = conn
+	go ext.Consume()
+	expectState(t, ext, STATE_CONNECTED)
+
+	ext.Disconnect("bye")
+	if got := <-conn.written; got != "QUIT :bye\n" {
+		t.Error("Should send QUIT. Sent", got)
+	}
+	close(conn.input) // Server hangs up
+
+	expectState(t, ext, STATE_CLOSED)
+	if !ext.Wait(time.Second) {
+		t.Error("Consume should stop after Disconnect")
+	}
+	if ext.isConnected() {
+		t.Error("Socket should be closed")
+	}
+}
+
+func TestExternal_disconnectWhenBusy(t *testing.T) {
+
+	conn := newFakeConn()
+	ext, _ := newTestExternal()
+	ext.socket = conn
+	go ext.Consume()
+	expectState(t, ext, STATE_CONNECTED)
+
+	ext.Disconnect("bye")
+	<-conn.written // QUIT
+
+	// Server ignores our QUIT, and keeps talking
+	ext.lock.Lock()
+	ext.quitAt = time.Now().Add(-2 * QUIT_WAIT_NS)
+	ext.lock.Unlock()
+	conn.input <- ":alice!a@example.com PRIVMSG #test :hi\n"
+
+	if !ext.Wait(time.Second) {
+		t.Error("Consume should stop QUIT_WAIT_NS after Disconnect, even if the server is busy")
+	}
+	if !conn.isClosed() {
+		t.Error("Socket should be closed")
+	}
+}
+
+func TestExternal_disconnectWhileReconnecting(t *testing.T) {
+
+	defer func() { dial = sock }()
+	dial = func(network string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	ext, _ := newTestExternal()
+	ext.socket = nil
+	go ext.Consume()
+	expectState(t, ext, STATE_RECONNECTING)
+
+	ext.Disconnect("")
+	expectState(t, ext, STATE_CLOSED)
+	if !ext.Wait(time.Second) {
+		t.Error("Consume should stop after Disconnect, even while waiting to reconnect")
+	}
+}
+
+func TestExternalManager_disconnect(t *testing.T) {
+
+	ext, sent := newTestExternal()
+	manager := &ExternalManager{connections: map[string]*External{ext.network: ext}, config: NewConfig()}
+
+	if manager.Disconnect("irc.other.com:6697", "") {
+		t.Error("Can't disconnect a network we don't have")
+	}
+	if !manager.Disconnect(ext.network, "") {
+		t.Error("Should disconnect network")
+	}
+	expectSent(t, sent, "QUIT :"+*quitMsg)
+	if len(manager.Networks()) != 0 {
+		t.Error("Disconnected network should be forgotten. Got", manager.Networks())
+	}
+}
+
+func TestExternalManager_shutdown(t *testing.T) {
+
+	polite := newFakeConn()
+	first, _ := newTestExternal()
+	first.socket = polite
+
+	rude := newFakeConn()
+	second, _ := newTestExternal()
+	second.network = "irc.other.com:6697"
+	second.socket = rude
+
+	manager := &ExternalManager{connections: map[string]*External{
+		first.network:  first,
+		second.network: second,
+	}}
+	go first.Consume()
+	go second.Consume()
+	expectState(t, first, STATE_CONNECTED)
+	expectState(t, second, STATE_CONNECTED)
+
+	go func() {
+		<-polite.written
+		close(polite.input) // Hangs up after QUIT, the other never does
+	}()
+	manager.Shutdown("bye", 100*time.Millisecond)
+
+	for _, ext := range []*External{first, second} {
+		if !ext.Wait(time.Second) {
+			t.Error("Consume should stop on shutdown", ext.network)
+		}
+	}
+	if <-rude.written != "QUIT :bye\n" {
+		t.Error("Every network should get QUIT")
+	}
+	if len(manager.Networks()) != 0 {
+		t.Error("Shutdown should forget networks")
+	}
+}
+
+func TestServer_shutdown(t *testing.T) {
+
+	manager := NewInternalManager("", "", make(chan Message, 10))
+	server := &Server{
+		internal: manager,
+		external: NewExternalManager(make(chan *Line, 10), NewConfig()),
+	}
+	internalConn, conn := newTestInternal(manager, "#test")
+	internalConn.Special("/hello 1 state")
+	_, legacyConn := newTestInternal(manager, "#test")
+
+	server.Shutdown("bye")
+
+	var line Line
+	json.Unmarshal([]byte(<-conn.written), &line)
+	if line.Command != "STATE" || line.Args[0] != STATE_STOPPING {
+		t.Error("Clients should hear we are stopping. Got", line)
+	}
+	select {
+	case got := <-legacyConn.written:
+		t.Error("Client that didn't announce state should not get STATE. Got", got)
+	default:
+	}
+	if !conn.isClosed() || !legacyConn.isClosed() {
+		t.Error("Client connections should be closed")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// Version of the hjoin <-> hatcogd protocol. Bump when it changes.
+	// Clients that never say hello are protocol 0.
+	PROTOCOL_VERSION = 1
+)
+
+var (
+	// What this daemon can do for a client
+	DAEMON_FEATURES = []string{
+		"caps",          // CAPS line after capability negotiation
+		"channel-state", // CHANNEL line with users, topic and modes when a window joins a channel we're in
+		"detach",        // Stay in channels with no window
+		"json",          // Json requests, see Request
+		"private-queue", // Hold private messages until a window opens
+		"replay",        // Scrollback on attach, and /backlog
+		"server-time",   // Received is the server's time
+		"state",         // STATE lines about the connection
+	}
+
+	// Our own lines, which only go to clients that asked for them in /hello
+	FEATURE_COMMANDS = map[string]string{
+		"CAPS":  "caps",
+		"STATE": "state",
+	}
+)
+
+// Daemon's reply to a client's /hello
+type Hello struct {
+	Line
+	Protocol   int      // Protocol we will speak to this client
+	Features   []string // DAEMON_FEATURES
+	Networks   []string // Networks we are connected to
+	Configured []string // Networks in our config file, which clients can /connect by name
+}
+
+func NewHello(protocol int, networks, configured []string) *Hello {
+	return &Hello{
+		Line:       *NewLine("", "HELLO", VERSION),
+		Protocol:   protocol,
+		Features:   DAEMON_FEATURES,
+		Networks:   networks,
+		Configured: configured,
+	}
+}
+
+// Hello as json, with our fields
+func (self *Hello) AsJson() []byte {
+	return asJson(self)
+}
+
+// Parse "/hello <protocol> [feature ...]". Returns the protocol we will
+// speak, which is the lower of the client's and ours, and the features
+// the client supports. ok is false if 'content' isn't a valid hello.
+func parseHello(content string) (protocol int, features []string, ok bool) {
+
+	parts := strings.Fields(content)
+	if len(parts) < 2 || parts[0] != "/hello" {
+		return 0, nil, false
+	}
+
+	protocol, err := strconv.Atoi(parts[1])
+	if err != nil || protocol < 1 {
+		return 0, nil, false
+	}
+	if protocol > PROTOCOL_VERSION {
+		protocol = PROTOCOL_VERSION
+	}
+
+	return protocol, parts[2:], true
+}
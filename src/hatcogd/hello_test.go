@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHello(t *testing.T) {
+
+	protocol, features, ok := parseHello("/hello 1 replay state")
+	if !ok || protocol != 1 || len(features) != 2 || features[0] != "replay" {
+		t.Error("Bad parse of hello. Got", protocol, features, ok)
+	}
+
+	// Newer client, we speak our version
+	protocol, _, ok = parseHello("/hello 99")
+	if !ok || protocol != PROTOCOL_VERSION {
+		t.Error("Should speak our protocol to a newer client. Got", protocol)
+	}
+
+	for _, bad := range []string{"/hello", "/hello one", "/hello 0", "/helloo 1"} {
+		if _, _, ok := parseHello(bad); ok {
+			t.Error("Should reject", bad)
+		}
+	}
+}
+
+func TestInternal_hello(t *testing.T) {
+
+	manager := NewInternalManager("", "", make(chan Message, 10))
+	ext, _ := newTestExternal()
+	server := &Server{
+		internal: manager,
+		external: &ExternalManager{connections: map[string]*External{"irc.example.com:6697": ext}, config: NewConfig()},
+	}
+	network := "irc.example.com:6697"
+	line, _ := ParseLine(":alice!a@example.com PRIVMSG #test :hi")
+	line.Network = network
+	manager.Record(line)
+
+	internalConn, conn := newTestInternal(manager, "")
+	if internalConn.Special("/hello 1 state") {
+		t.Error("/hello should go on to the server, for the reply")
+	}
+	server.onUser(Message{"", "", "/hello 1 state", internalConn, nil})
+
+	var hello Hello
+	json.Unmarshal([]byte(<-conn.written), &hello)
+	if hello.Command != "HELLO" || hello.Content != VERSION || hello.Protocol != 1 {
+		t.Error("Bad hello reply. Got", hello)
+	}
+	if len(hello.Networks) != 1 || hello.Networks[0] != network {
+		t.Error("Hello should list our networks. Got", hello.Networks)
+	}
+
+	// Client didn't ask for replay, so doesn't get scrollback
+	internalConn.Special("/join #test")
+	select {
+	case got := <-conn.written:
+		t.Error("Client without replay should not get scrollback. Got", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Bad hello gets an error, and goes no further
+	if !internalConn.Special("/hello x") {
+		t.Error("Bad hello should stop here")
+	}
+	json.Unmarshal([]byte(<-conn.written), &hello)
+	if hello.Command != "ERROR" {
+		t.Error("Bad hello should get an error. Got", hello)
+	}
+}
+
+func TestServer_featureLines(t *testing.T) {
+
+	manager := NewInternalManager("", "", make(chan Message, 10))
+	server := &Server{
+		internal: manager,
+		external: &ExternalManager{connections: map[string]*External{}, config: NewConfig()},
+	}
+	network := "irc.example.com:6697"
+	stateConn, stateWritten := newTestInternal(manager, "#test")
+	stateConn.Special("/hello 1 state")
+	capsConn, capsWritten := newTestInternal(manager, "#test")
+	capsConn.Special("/hello 1 caps")
+
+	server.onServer(&Line{Network: network, Command: "STATE", Args: []string{STATE_CONNECTED}})
+	server.onServer(&Line{Network: network, Command: "CAPS", Content: "server-time"})
+
+	if got := <-stateWritten.written; !strings.Contains(got, `"Command":"STATE"`) {
+		t.Error("Expected STATE. Got", got)
+	}
+	if got := <-capsWritten.written; !strings.Contains(got, `"Command":"CAPS"`) {
+		t.Error("Expected CAPS. Got", got)
+	}
+	for _, conn := range []*fakeConn{stateWritten, capsWritten} {
+		select {
+		case got := <-conn.written:
+			t.Error("Each client should only get what it announced. Got", got)
+		default:
+		}
+	}
+}
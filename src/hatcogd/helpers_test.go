@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An External connected to a fake server. Lines it sends arrive on the returned channel.
+func newTestExternal() (*External, chan string) {
+
+	client, server := net.Pipe()
+	sent := make(chan string, 100)
+	go func() {
+		bufRead := bufio.NewReader(server)
+		for {
+			content, err := bufRead.ReadString('\n')
+			if err != nil {
+				close(sent)
+				return
+			}
+			sent <- strings.TrimRight(content, "\n")
+		}
+	}()
+
+	ext := &External{
+		network:    "irc.example.com:6697",
+		addr:       "irc.example.com:6697",
+		socket:     client,
+		fromServer: make(chan *Line, 100),
+		rawLog:     log.New(ioutil.Discard, "", 0),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		caps:       NewCapabilities(),
+		isupport:   NewISupport(),
+		channels:   make(map[string]string),
+		chanStates: make(map[string]*ChannelState),
+		keys:       make(map[string]string),
+	}
+	return ext, sent
+}
+
+// Feed a raw server line to an External
+func serverSays(ext *External, raw string) {
+	line, _ := ParseLine(raw)
+	line.Network = ext.network
+	ext.act(line)
+}
+
+func expectSent(t *testing.T, sent chan string, expected string) {
+	select {
+	case got := <-sent:
+		if got != expected {
+			t.Error("Expected", expected, "Got", got)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timeout waiting for", expected)
+	}
+}
+
+// A net.Conn for driving failures. Reads come from 'input' until it is
+// closed, then fail with readErr. Writes fail with writeErr, if set.
+type fakeConn struct {
+	input    chan string
+	readErr  error
+	writeErr error
+	written  chan string
+	closed   chan bool
+	once     sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		input:   make(chan string, 10),
+		readErr: io.EOF,
+		written: make(chan string, 100),
+		closed:  make(chan bool),
+	}
+}
+
+func (self *fakeConn) Read(b []byte) (int, error) {
+	select {
+	case data, ok := <-self.input:
+		if !ok {
+			return 0, self.readErr
+		}
+		return copy(b, data), nil
+	case <-self.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (self *fakeConn) Write(b []byte) (int, error) {
+	if self.writeErr != nil {
+		return 0, self.writeErr
+	}
+	self.written <- string(b)
+	return len(b), nil
+}
+
+func (self *fakeConn) Close() error {
+	self.once.Do(func() { close(self.closed) })
+	return nil
+}
+
+func (self *fakeConn) isClosed() bool {
+	select {
+	case <-self.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *fakeConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (self *fakeConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (self *fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (self *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (self *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newTestInternal(manager *InternalManager, channel string) (*Internal, *fakeConn) {
+	conn := newFakeConn()
+	internalConn := &Internal{
+		netConn: conn,
+		channel: channel,
+		network: "irc.example.com:6697",
+		manager: manager,
+
+		isAuthenticated: true}
+	manager.add(internalConn)
+	return internalConn, conn
+}
+
+// A net.Listener whose Accept fails
+type fakeListener struct {
+	errs chan error
+}
+
+func (self *fakeListener) Accept() (net.Conn, error) { return nil, <-self.errs }
+func (self *fakeListener) Close() error              { return nil }
+func (self *fakeListener) Addr() net.Addr            { return &net.TCPAddr{} }
+
+// Point -logdir at a new temporary directory. Call the returned func to clean up.
+func useTempLogdir(t *testing.T) func() {
+
+	dir, err := ioutil.TempDir("", "hatcogd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := *logdir
+	*logdir = dir
+
+	return func() {
+		*logdir = previous
+		os.RemoveAll(dir)
+	}
+}
+
+// Wait for the next STATE line from an External
+func expectState(t *testing.T, ext *External, expected string) {
+	for {
+		select {
+		case line := <-ext.fromServer:
+			if line.Command != "STATE" {
+				continue
+			}
+			if line.Args[0] != expected {
+				t.Fatal("Expected state", expected, "Got", line)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for state", expected)
+		}
+	}
+}
@@ -6,44 +6,66 @@ import (
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Internal struct {
-	netConn   net.Conn
-	channel   string // channel or nick (for private/query messages)
-	network   string // address of remote we use (e.g. "irc.freenode.net:6697")
-	isPrivate bool   // if True, channel is the nick
-	manager   *InternalManager
+	id              int // Unique, set by InternalManager
+	netConn         net.Conn
+	isAuthenticated bool     // Sent the token
+	channel         string   // channel or nick (for private/query messages)
+	network         string   // address of remote we use (e.g. "irc.freenode.net:6697")
+	isPrivate       bool     // if True, channel is the nick
+	protocol        int      // From /hello, 0 if the client didn't say hello
+	features        []string // What the client supports, from /hello
+	hasLeft         bool     // Sent /leave, so don't stay in the channel when we close
+	manager         *InternalManager
 }
 
 func (self *Internal) Run() {
 	defer logPanic()
 
+	bufRead := bufio.NewReader(self.netConn)
+
+	if !self.isAuthenticated && !self.authenticate(bufRead) {
+		self.netConn.Close()
+		self.manager.delete(self)
+		return
+	}
+
 	// Send NICK msg to new client connections
 	self.sendNick()
 
 	for {
 
-		bufRead := bufio.NewReader(self.netConn)
 		content, err := bufRead.ReadString('\n')
 		if err != nil {
 			if err == io.EOF {
-				log.Println("Leaving", self.channel)
-				self.part()
-				self.manager.delete(self)
+				log.Println("Internal", self.id, "closed", self.channel)
 			} else {
-				log.Println(err)
+				log.Println("Dropping internal connection", self.id, "for", self.channel, ":", err)
+			}
+			self.netConn.Close()
+			if self.manager.delete(self) {
+				// Last window on that channel
+				self.detach()
 			}
 			return
 		}
 		content = content[:len(content)-1] // Chop \n
 
+		if request, ok := parseRequest(content); ok {
+			self.onRequest(request)
+			continue
+		}
+
 		if self.Special(content) {
 			continue
 		}
 
-		self.manager.fromUser <- Message{self.network, self.channel, content}
+		self.manager.fromUser <- Message{self.network, self.channel, content, self, nil}
 	}
 }
 
@@ -60,11 +82,37 @@ func (self *Internal) Special(content string) bool {
 
 	var parts []string
 
+	// Only this goroutine changes our fields, so reading them is safe,
+	// but the manager reads them too, so we change them with its lock.
+	manager := self.manager
+
+	if strings.HasPrefix(content, "/hello") {
+		protocol, features, ok := parseHello(content)
+		if !ok {
+			self.writeError("Bad hello. Expected /hello <protocol> [feature ...]")
+			return true
+		}
+		log.Println("Internal", self.id, "speaks protocol", protocol, "features", features)
+
+		manager.lock.Lock()
+		self.protocol = protocol
+		self.features = features
+		manager.lock.Unlock()
+
+		// Server replies, it knows our networks
+		return false
+	}
+
 	if self.network == "" && strings.HasPrefix(content, "/connect") {
 		parts = strings.Split(content, " ")
 		if len(parts) == 2 {
 			log.Println("parts1: ", parts[1])
-			self.network, _ = splitNetPass(parts[1])
+			network, _ := splitNetPass(parts[1])
+
+			manager.lock.Lock()
+			self.network = network
+			manager.lock.Unlock()
+
 			log.Println("Network is", self.network)
 		}
 	}
@@ -72,22 +120,50 @@ func (self *Internal) Special(content string) bool {
 	if self.channel == "" {
 
 		isPrivate := strings.HasPrefix(content, "/private")
-		self.isPrivate = isPrivate
-
 		isJoin := strings.HasPrefix(content, "/join")
 
+		channel := ""
 		if isJoin || isPrivate {
 			parts = strings.Split(content, " ")
 			if len(parts) == 2 {
-				self.channel = parts[1]
+				channel = parts[1]
+			}
+		}
+
+		manager.lock.Lock()
+		self.isPrivate = isPrivate
+		self.channel = channel
+		manager.lock.Unlock()
+
+		// Show the new window what it missed
+		count := *backlog
+		if isReattach, missed := manager.Reattach(self.network, channel); isReattach {
+			log.Println("Reattaching to", channel, "missed", missed, "lines")
+			if missed > count {
+				count = missed
 			}
+			// We're already in the channel, so the server won't send the user list.
+			// A channel-state client gets it from us instead.
+			if !self.announced("channel-state") {
+				manager.fromUser <- Message{self.network, channel, "/names " + channel, self, nil}
+			}
+		}
+		if channel != "" {
+			self.sendBacklog(count)
+		}
+
+		if isJoin {
+			// Private messages with nobody to open their window. Not for a
+			// /private window, it might be the one we'd be asking for.
+			manager.PromptAll(self)
 		}
 
 		if isPrivate {
-			// Send most recent private message, so new window shows it
-			if self.manager.lastPrivate != nil {
-				self.netConn.Write(self.manager.lastPrivate)
-				self.manager.lastPrivate = nil
+			// Send the messages that were waiting for this window.
+			// They go in scrollback now that someone has seen them.
+			for _, line := range manager.takePrivate(self.network, channel) {
+				self.Write(line.AsJson())
+				manager.Record(line)
 			}
 
 			// Not an IRC server command, so don't send to IRC server
@@ -95,6 +171,144 @@ func (self *Internal) Special(content string) bool {
 		}
 	}
 
+	if strings.HasPrefix(content, "/private") {
+		// Not an IRC server command either
+		self.writeError("Already a window on " + self.channel)
+		return true
+	}
+
+	if content == "/leave" {
+		// Really leave the channel, even in detach mode
+		self.manager.Forget(self.network, self.channel)
+		self.hasLeft = true
+		self.part()
+		return true
+	}
+
+	if strings.HasPrefix(content, "/backlog") {
+		// Client wants to see more scrollback
+		count := *backlog
+		parts = strings.Split(content, " ")
+		if len(parts) == 2 {
+			num, err := strconv.Atoi(parts[1])
+			if err == nil {
+				count = num
+			}
+		}
+		self.sendBacklog(count)
+		return true
+	}
+
+	return false
+}
+
+// Do what a json request asks, the same way as the matching text line,
+// and tell the client whether we could.
+func (self *Internal) onRequest(request *Request) {
+
+	content, errCode, msg := request.asText()
+	if errCode != "" {
+		self.Write(NewReply(request.Id, errCode, msg).AsJson())
+		return
+	}
+
+	if request.Type == "private" && self.channel != "" {
+		self.Write(NewReply(request.Id, ERR_BAD_REQUEST, "Already a window on "+self.channel).AsJson())
+		return
+	}
+
+	// A script joining a channel stays a script. Special would make it
+	// that channel's window.
+	if request.Type != "join" && self.Special(content) {
+		// Done already
+		self.Write(NewReply(request.Id, "", request.Type).AsJson())
+		return
+	}
+
+	// Our window's network and channel, unless the request says otherwise
+	network, channel := self.network, self.channel
+	if request.Network != "" && request.Type != "connect" {
+		network = request.Network
+	}
+	if request.Target != "" {
+		channel = request.Target
+	}
+	if channel == "" && (request.Type == "privmsg" || request.Type == "action") {
+		// A script isn't a window, so it has to say who to
+		self.Write(NewReply(request.Id, ERR_MISSING_FIELD, request.Type+" needs target").AsJson())
+		return
+	}
+
+	// Server replies
+	self.manager.fromUser <- Message{network, channel, content, self, request}
+}
+
+// Send the most recent 'count' lines of our channel's scrollback.
+// Returns how many lines we sent.
+func (self *Internal) sendBacklog(count int) int {
+
+	if !self.supports("replay") {
+		return 0
+	}
+
+	lines := self.manager.Backlog(self.network, self.channel, count)
+	for _, line := range lines {
+		self.Write(line.AsJson())
+	}
+	return len(lines)
+}
+
+// The first line from a client must be "/auth <token>". If it isn't,
+// tell the client and return false.
+func (self *Internal) authenticate(bufRead *bufio.Reader) bool {
+
+	// Don't let clients that never authenticate hold a connection open
+	self.netConn.SetReadDeadline(time.Now().Add(self.manager.authWait))
+	content, err := bufRead.ReadString('\n')
+	self.netConn.SetReadDeadline(time.Time{})
+
+	if err == nil && isValidAuth(strings.TrimRight(content, "\r\n"), self.manager.token) {
+		self.isAuthenticated = true
+		return true
+	}
+
+	log.Println("Rejecting unauthenticated internal connection", self.id, "from", self.netConn.RemoteAddr())
+	self.writeError("Not authenticated. First line must be /auth <token from " + tokenPath() + ">")
+	return false
+}
+
+// Tell the client something went wrong
+func (self *Internal) writeError(msg string) {
+	self.Write(NewLine("", "ERROR", msg).AsJson())
+}
+
+// Does the client support 'feature'. Clients from before /hello get
+// everything, because that's what they always got.
+func (self *Internal) supports(feature string) bool {
+	self.manager.lock.RLock()
+	isLegacy := self.protocol == 0
+	self.manager.lock.RUnlock()
+
+	return isLegacy || self.announced(feature)
+}
+
+// Did the client say in /hello that it supports 'feature'. Lines old
+// clients wouldn't understand check this, not supports.
+func (self *Internal) announced(feature string) bool {
+	self.manager.lock.RLock()
+	defer self.manager.lock.RUnlock()
+
+	return self.hasFeature(feature)
+}
+
+// announced, for callers that hold the manager's lock
+func (self *Internal) hasFeature(feature string) bool {
+
+	for _, has := range self.features {
+		if has == feature {
+			return true
+		}
+	}
 	return false
 }
 
@@ -112,15 +326,45 @@ func (self *Internal) sendNick() {
 		User:    ""}
 
 	jsonData, _ := json.Marshal(line)
-	self.netConn.Write(append(jsonData, '\n'))
+	self.Write(append(jsonData, '\n'))
+}
+
+// Send data to the client. If that fails we close the connection,
+// and Run drops this client.
+func (self *Internal) Write(msg []byte) (int, error) {
+
+	bytesWritten, err := self.netConn.Write(msg)
+	if err != nil {
+		log.Println("Error writing to internal connection", self.netConn.RemoteAddr(), ":", err)
+		self.netConn.Close()
+	}
+	return bytesWritten, err
+}
+
+// Last client on our channel closed it's connection. Either leave
+// the channel, or in detach mode stay in it so a later window can reattach.
+func (self *Internal) detach() {
+
+	if self.channel == "" || self.isPrivate || self.hasLeft {
+		// hasLeft: /leave already sent PART
+		return
+	}
+
+	if *detach {
+		log.Println("Staying in", self.channel, "with no window")
+		self.manager.Detach(self.network, self.channel)
+		return
+	}
+	self.part()
 }
 
-// Client closed connection, leave channel, no more work here
+// Leave our channel
 func (self *Internal) part() {
 
 	if self.channel == "" || self.isPrivate {
 		return
 	}
 
-	self.manager.fromUser <- Message{self.network, self.channel, "/part " + self.channel}
+	log.Println("Leaving", self.channel)
+	self.manager.fromUser <- Message{self.network, self.channel, "/part " + self.channel, self, nil}
 }
@@ -1,23 +1,62 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 )
 
+const (
+	ACCEPT_RETRY_NS = ONE_SECOND_NS / 10 // Wait after a failed Accept
+
+	// Most private messages we hold for a nick with no window open
+	PRIVATE_QUEUE_SIZE = 50
+
+	// Unix socket for internal connections, in logdir
+	SOCKET_NAME = "hatcogd.sock"
+)
+
+// Internals run in their own goroutines, and Server calls us from its
+// goroutine, so 'lock' guards connections, nicks, private, scrollback, casemaps,
+// and the channel, network, isPrivate, protocol and features fields of
+// every Internal.
 type InternalManager struct {
 	host        string
 	port        string
+	listeners   []net.Listener // TCP, Unix socket, or both
+	token       string         // Shared secret clients must send first
+	authWait    time.Duration  // How long they have to send it
+	lock        sync.RWMutex
+	lastId      int // Each Internal gets the next id
 	connections []*Internal
 	nicks       map[string]string
 	fromUser    chan Message
-	lastPrivate []byte // Most recent private message
+	private     map[chanKey]*privateQueue // Private messages waiting for a window, by nick
+	scrollback  map[chanKey]*Scrollback
+	detached    map[chanKey]int   // Channels we stayed in with no window, and the scrollback Total when the last window closed
+	casemaps    map[string]string // CASEMAPPING of each network, from RPL_ISUPPORT
+}
+
+// Private messages from one nick, waiting for a /private window
+type privateQueue struct {
+	lines      []*Line
+	dropped    int // Messages we lost because the queue was full
+	promptedId int // Client we asked to open a window, 0 if none
 }
 
 type Message struct {
 	network string
 	channel string
 	content string
+	from    *Internal // Client that sent it, for replies
+	request *Request  // If it came as json, so Server can reply when it's done
 }
 
 func NewInternalManager(host, port string, fromUser chan Message) *InternalManager {
@@ -26,33 +65,137 @@ func NewInternalManager(host, port string, fromUser chan Message) *InternalManag
 	return &InternalManager{
 		host:        host,
 		port:        port,
+		authWait:    AUTH_WAIT_NS,
 		connections: connections,
 		nicks:       make(map[string]string),
 		fromUser:    fromUser,
-		lastPrivate: nil}
+		private:     make(map[chanKey]*privateQueue),
+		scrollback:  make(map[chanKey]*Scrollback),
+		detached:    make(map[chanKey]int),
+		casemaps:    make(map[string]string)}
 }
 
-// Act as a server, forward data to irc connection
+// Start listening for client connections, on TCP, a Unix socket, or both,
+// depending on the -listen flag.
+func (self *InternalManager) Listen() error {
+
+	if *listenOn != "tcp" && *listenOn != "unix" && *listenOn != "both" {
+		return errors.New("-listen must be tcp, unix or both. Got: " + *listenOn)
+	}
+
+	var err error
+	self.token, err = loadToken(tokenPath())
+	if err != nil {
+		return err
+	}
+	log.Println("Clients authenticate with the token in", tokenPath())
+
+	if *listenOn != "unix" {
+		listener, err := net.Listen("tcp", self.host+":"+self.port)
+		if err != nil {
+			return err
+		}
+		if !isLoopback(self.host) {
+			listener, err = listenTLS(listener)
+			if err != nil {
+				return err
+			}
+		}
+		log.Println("Listening for internal connection on " + self.host + ":" + self.port)
+		self.listeners = append(self.listeners, listener)
+	}
+
+	if *listenOn != "tcp" {
+		listener, err := listenUnix(socketPath())
+		if err != nil {
+			self.Close()
+			return err
+		}
+		log.Println("Listening for internal connection on", socketPath())
+		self.listeners = append(self.listeners, listener)
+	}
+
+	return nil
+}
+
+// Wrap a TCP listener other machines can reach in TLS
+func listenTLS(listener net.Listener) (net.Listener, error) {
+
+	certPath, keyPath := certPaths()
+	cert, err := loadCert(certPath, keyPath)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	log.Println("Clients on other machines need a copy of", certPath)
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	return tls.NewListener(listener, config), nil
+}
+
+// Unix socket only we (our user) can connect to
+func listenUnix(path string) (net.Listener, error) {
+
+	// Left over from a previous run
+	os.Remove(path)
+
+	// No window where the socket exists with wider permissions
+	oldMask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Where the Unix socket for internal connections lives
+func socketPath() string {
+	return filepath.Join(*logdir, SOCKET_NAME)
+}
+
+// Act as a server, forward data to irc connection.
+// Returns when all the listeners are closed.
 func (self *InternalManager) Run() {
 	defer logPanic()
 
-	var listener net.Listener
+	var wait sync.WaitGroup
+	for _, listener := range self.listeners {
+		wait.Add(1)
+		go func(listener net.Listener) {
+			defer wait.Done()
+			self.accept(listener)
+		}(listener)
+	}
+	wait.Wait()
+}
+
+// Accept connections on one listener, until it is closed
+func (self *InternalManager) accept(listener net.Listener) {
+	defer logPanic()
+
 	var netConn net.Conn
 	var internalConn *Internal
 	var err error
 
-	listener, err = net.Listen("tcp", self.host+":"+self.port)
-
-	if err != nil {
-		log.Fatal("Error on internal listen: " + err.Error())
-	}
 	defer listener.Close()
 
 	for {
 		netConn, err = listener.Accept()
 		if err != nil {
-			log.Fatal("Listener accept error: " + err.Error())
-			break
+			if errors.Is(err, net.ErrClosed) {
+				log.Println("Internal listener closed:", listener.Addr())
+				return
+			}
+			log.Println("Listener accept error:", err)
+			time.Sleep(ACCEPT_RETRY_NS)
+			continue
 		}
 
 		internalConn = &Internal{
@@ -60,32 +203,283 @@ func (self *InternalManager) Run() {
 			channel: "",
 			network: "",
 			manager: self}
-		self.connections = append(self.connections, internalConn)
+		self.add(internalConn)
 		go internalConn.Run()
 	}
 
 }
 
+// Add a new client connection, giving it a unique id
+func (self *InternalManager) add(internalConn *Internal) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.lastId++
+	internalConn.id = self.lastId
+	self.connections = append(self.connections, internalConn)
+}
+
 // Set the nickname used on a network
 func (self *InternalManager) SetNick(network, nick string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	self.nicks[network] = nick
 }
 
 // The nickname used on a given network
 func (self *InternalManager) GetNick(network string) string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
 	return self.nicks[network]
 }
 
+// Match channels and nicks on 'network' using it's CASEMAPPING
+func (self *InternalManager) SetCaseMapping(network, casemapping string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.casemaps[network] = casemapping
+}
+
+// Are two nicks or channels on 'network' the same
+func (self *InternalManager) IsSameName(network, a, b string) bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	return self.fold(network, a) == self.fold(network, b)
+}
+
+// A channel or nick in the network's casemapping. Call with lock held.
+func (self *InternalManager) fold(network, name string) string {
+	casemapping, ok := self.casemaps[network]
+	if !ok {
+		casemapping = CASEMAPPING_RFC1459 // Until the server tells us
+	}
+	return foldCase(casemapping, name)
+}
+
+// Key for a channel or nick in our maps. Call with lock held.
+func (self *InternalManager) key(network, channel string) chanKey {
+	return chanKey{network, self.fold(network, channel)}
+}
+
+// Is 'conn' a window on 'channel'. Call with lock held.
+func (self *InternalManager) isOn(conn *Internal, network, channel string) bool {
+	return conn.network == network && self.fold(network, conn.channel) == self.fold(network, channel)
+}
+
+// Hold a private message until a window opens for it, unless a window is
+// already open. Returns how many messages are waiting for that window,
+// 0 if there's a window.
+func (self *InternalManager) QueuePrivate(line *Line) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for _, conn := range self.connections {
+		if self.isOn(conn, line.Network, line.Channel) {
+			return 0
+		}
+	}
+
+	key := self.key(line.Network, line.Channel)
+	queue := self.private[key]
+	if queue == nil {
+		queue = &privateQueue{}
+		self.private[key] = queue
+	}
+
+	if len(queue.lines) == PRIVATE_QUEUE_SIZE {
+		queue.lines = queue.lines[1:]
+		queue.dropped++
+	}
+	queue.lines = append(queue.lines, line)
+
+	return len(queue.lines) + queue.dropped
+}
+
+// Ask a client on 'network' to open a window for the private messages from
+// 'nick', if we haven't already. If no client is on the network we ask the
+// next window that opens, in PromptAll.
+func (self *InternalManager) PromptPrivate(network, nick string) {
+
+	self.lock.RLock()
+	queue := self.private[self.key(network, nick)]
+	if queue == nil || queue.promptedId != 0 {
+		self.lock.RUnlock()
+		return
+	}
+	prompt := queue.lines[len(queue.lines)-1].AsJson()
+	self.lock.RUnlock()
+
+	conns := self.find(func(conn *Internal) bool {
+		return conn.network == network
+	})
+	if len(conns) == 0 {
+		return
+	}
+	if _, err := conns[0].Write(prompt); err != nil {
+		return
+	}
+
+	self.lock.Lock()
+	queue.promptedId = conns[0].id
+	self.lock.Unlock()
+}
+
+// Ask a window that just opened on a channel to open windows for every
+// nick with private messages waiting, unless we already asked a client
+// that's still here. Earlier prompts may have gone to nobody.
+func (self *InternalManager) PromptAll(internalConn *Internal) {
+
+	var prompts [][]byte
+	self.lock.Lock()
+	for key, queue := range self.private {
+		if key.network == internalConn.network && queue.promptedId == 0 {
+			prompts = append(prompts, queue.lines[len(queue.lines)-1].AsJson())
+			queue.promptedId = internalConn.id
+		}
+	}
+	self.lock.Unlock()
+
+	for _, prompt := range prompts {
+		internalConn.Write(prompt)
+	}
+}
+
+// Remove and return the private messages waiting for a window on 'nick',
+// oldest first. If some were lost, the first line is a notice saying so.
+func (self *InternalManager) takePrivate(network, nick string) []*Line {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	key := self.key(network, nick)
+	queue := self.private[key]
+	if queue == nil {
+		return nil
+	}
+	delete(self.private, key)
+
+	if queue.dropped == 0 {
+		return queue.lines
+	}
+
+	notice := NewLine(network, "NOTICE", fmt.Sprintf("%d earlier private messages from %s were dropped", queue.dropped, nick))
+	notice.Channel = nick
+	return append([]*Line{notice}, queue.lines...)
+}
+
+// Keep a line in it's channel's scrollback, if it's worth replaying
+func (self *InternalManager) Record(line *Line) {
+
+	if !isScrollbackCommand(line.Command) {
+		return
+	}
+
+	channels := []string{line.Channel}
+	if line.Command == "QUIT" || line.Command == "NICK" {
+		// Goes in every channel the user was in
+		channels = line.Channels
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	replay := *line
+	replay.IsReplay = true
+	for _, channel := range channels {
+		if channel == "" {
+			continue
+		}
+		key := self.key(line.Network, channel)
+		if self.scrollback[key] == nil {
+			self.scrollback[key] = NewScrollback(SCROLLBACK_SIZE)
+		}
+		self.scrollback[key].Add(&replay)
+	}
+}
+
+// The most recent 'count' lines in a channel, oldest first
+func (self *InternalManager) Backlog(network, channel string, count int) []*Line {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	scrollback := self.scrollback[self.key(network, channel)]
+	if scrollback == nil {
+		return nil
+	}
+	return scrollback.Last(count)
+}
+
+// The last window on a channel closed, but we stay in the channel.
+// Remember where the scrollback was, so we can replay all of it on reattach.
+func (self *InternalManager) Detach(network, channel string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	key := self.key(network, channel)
+	mark := 0
+	if self.scrollback[key] != nil {
+		mark = self.scrollback[key].Total()
+	}
+	self.detached[key] = mark
+}
+
+// A window opened on a channel. If we had stayed in the channel with no
+// window, returns true and how many lines were said since the last window
+// closed. Otherwise returns false.
+func (self *InternalManager) Reattach(network, channel string) (bool, int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	key := self.key(network, channel)
+	mark, isDetached := self.detached[key]
+	if !isDetached {
+		return false, 0
+	}
+	delete(self.detached, key)
+
+	if self.scrollback[key] == nil {
+		return true, 0
+	}
+	return true, self.scrollback[key].Since(mark)
+}
+
+// Forget a channel we stayed in, because we left it
+func (self *InternalManager) Forget(network, channel string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	delete(self.detached, self.key(network, channel))
+}
+
+// The connections 'match' returns true for. We write to them without
+// holding the lock, so a slow client doesn't hold up the others.
+func (self *InternalManager) find(match func(conn *Internal) bool) []*Internal {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	var found []*Internal
+	for _, conn := range self.connections {
+		if match(conn) {
+			found = append(found, conn)
+		}
+	}
+	return found
+}
+
 // Write a message to channel connection
 func (self *InternalManager) WriteChannel(network, channel string, msg []byte) (int, error) {
 
 	var bytesWritten int
 
-	for _, conn := range self.connections {
-		if conn.channel == channel && conn.network == network {
-			conn.netConn.Write(msg)
-			bytesWritten += len(msg)
-		}
+	conns := self.find(func(conn *Internal) bool {
+		return self.isOn(conn, network, channel)
+	})
+	for _, conn := range conns {
+		conn.Write(msg)
+		bytesWritten += len(msg)
 	}
 
 	return bytesWritten, nil
@@ -95,11 +489,46 @@ func (self *InternalManager) WriteChannel(network, channel string, msg []byte) (
 func (self *InternalManager) WriteAll(network string, msg []byte) (int, error) {
 
 	var bytesWritten int
-	for _, conn := range self.connections {
-		if conn.network == network {
-			conn.netConn.Write(msg)
-			bytesWritten += len(msg)
-		}
+
+	conns := self.find(func(conn *Internal) bool {
+		return conn.network == network
+	})
+	for _, conn := range conns {
+		conn.Write(msg)
+		bytesWritten += len(msg)
+	}
+
+	return bytesWritten, nil
+}
+
+// Write a message to the client connections on 'network' that announced
+// 'feature' in /hello. An empty network means every network.
+func (self *InternalManager) WriteFeature(network, feature string, msg []byte) (int, error) {
+
+	var bytesWritten int
+
+	conns := self.find(func(conn *Internal) bool {
+		return (network == "" || conn.network == network) && conn.hasFeature(feature)
+	})
+	for _, conn := range conns {
+		conn.Write(msg)
+		bytesWritten += len(msg)
+	}
+
+	return bytesWritten, nil
+}
+
+// Write a message to every client connection, whatever it's network
+func (self *InternalManager) WriteEveryone(msg []byte) (int, error) {
+
+	var bytesWritten int
+
+	conns := self.find(func(conn *Internal) bool {
+		return true
+	})
+	for _, conn := range conns {
+		conn.Write(msg)
+		bytesWritten += len(msg)
 	}
 
 	return bytesWritten, nil
@@ -110,38 +539,55 @@ func (self *InternalManager) WriteAll(network string, msg []byte) (int, error) {
 // matter which one it goes to. Used to open a private chat window.
 func (self *InternalManager) WriteFirst(network string, msg []byte) (int, error) {
 
-	var bytesWritten int
-	var err error
-
-	for _, conn := range self.connections {
-		if conn.network == network {
-			bytesWritten, err = conn.netConn.Write(msg)
-			break
-		}
+	conns := self.find(func(conn *Internal) bool {
+		return conn.network == network
+	})
+	if len(conns) == 0 {
+		return 0, nil
 	}
 
-	return bytesWritten, err
+	return conns[0].Write(msg)
 }
 
-// Remove a connection from our list, probably because user closed it
-func (self *InternalManager) delete(internalConn *Internal) {
-	if len(self.connections) == 0 {
-		return
-	}
+// Remove a connection from our list, probably because user closed it.
+// Returns true if no other connection is open on that network and channel,
+// so we can leave it.
+func (self *InternalManager) delete(internalConn *Internal) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	isLast := true
 
-	newConnections := make([]*Internal, 0, len(self.connections)-1)
+	newConnections := make([]*Internal, 0, len(self.connections))
 	for _, conn := range self.connections {
-		if conn.channel != internalConn.channel {
-			newConnections = append(newConnections, conn)
+		if conn.id == internalConn.id {
+			continue
+		}
+		newConnections = append(newConnections, conn)
+
+		if self.isOn(conn, internalConn.network, internalConn.channel) {
+			isLast = false
 		}
 	}
 	self.connections = newConnections
+
+	for _, queue := range self.private {
+		if queue.promptedId == internalConn.id {
+			// It won't open the window now, ask the next one
+			queue.promptedId = 0
+		}
+	}
+
+	return isLast
 }
 
-// The internal connection for given channel, or nil
-func (self *InternalManager) GetChannelConnection(channel string) *Internal {
+// The internal connection for given network and channel, or nil
+func (self *InternalManager) GetChannelConnection(network, channel string) *Internal {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
 	for _, conn := range self.connections {
-		if conn.channel == channel {
+		if self.isOn(conn, network, channel) {
 			return conn
 		}
 	}
@@ -149,11 +595,17 @@ func (self *InternalManager) GetChannelConnection(channel string) *Internal {
 }
 
 // Do we have a connection (a client) open on given channel or nick
-func (self *InternalManager) HasChannel(channel string) bool {
-	return self.GetChannelConnection(channel) != nil
+func (self *InternalManager) HasChannel(network, channel string) bool {
+	return self.GetChannelConnection(network, channel) != nil
 }
 
 func (self *InternalManager) Close() error {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	for _, listener := range self.listeners {
+		listener.Close()
+	}
 	for _, conn := range self.connections {
 		conn.netConn.Close()
 	}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	RPL_ISUPPORT = "005"
+)
+
+var (
+	// What we assume until the server tells us otherwise, from RFC 1459
+	ISUPPORT_DEFAULTS = map[string]string{
+		"CASEMAPPING": CASEMAPPING_RFC1459,
+		"CHANMODES":   "b,k,l,imnpst",
+		"CHANTYPES":   "#&",
+		"NICKLEN":     "9",
+		"PREFIX":      "(ov)@+",
+	}
+)
+
+// What a server told us it supports in RPL_ISUPPORT (005) lines.
+// See http://modern.ircdocs.horse/#rplisupport-parameters
+type ISupport struct {
+	tokens map[string]string
+}
+
+func NewISupport() *ISupport {
+	tokens := make(map[string]string)
+	for key, value := range ISUPPORT_DEFAULTS {
+		tokens[key] = value
+	}
+	return &ISupport{tokens: tokens}
+}
+
+// Add the tokens from a 005 line's args, without our nick at the start.
+// "-KEY" means the server doesn't support KEY any more.
+func (self *ISupport) Update(args []string) {
+
+	for _, arg := range args {
+		if arg == "" {
+			continue
+		}
+
+		if arg[0] == '-' {
+			key := arg[1:]
+			if value, isDefault := ISUPPORT_DEFAULTS[key]; isDefault {
+				self.tokens[key] = value
+			} else {
+				delete(self.tokens, key)
+			}
+			continue
+		}
+
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) == 2 {
+			self.tokens[parts[0]] = unescapeISupport(parts[1])
+		} else {
+			self.tokens[parts[0]] = ""
+		}
+	}
+}
+
+// Value of a token, and whether the server has it
+func (self *ISupport) Get(key string) (string, bool) {
+	value, ok := self.tokens[key]
+	return value, ok
+}
+
+// Copy of all the tokens
+func (self *ISupport) Tokens() map[string]string {
+	tokens := make(map[string]string, len(self.tokens))
+	for key, value := range self.tokens {
+		tokens[key] = value
+	}
+	return tokens
+}
+
+// Characters channel names start with
+func (self *ISupport) ChanTypes() string {
+	return self.tokens["CHANTYPES"]
+}
+
+// Is 'name' a channel, rather than a nick
+func (self *ISupport) IsChannel(name string) bool {
+	return name != "" && strings.IndexByte(self.ChanTypes(), name[0]) != -1
+}
+
+// Channel membership modes and their nick prefixes, e.g. "ov" and "@+",
+// highest first
+func (self *ISupport) Prefixes() (modes, symbols string) {
+
+	prefix := self.tokens["PREFIX"]
+	if !strings.HasPrefix(prefix, "(") || !strings.Contains(prefix, ")") {
+		return "", ""
+	}
+	parts := strings.SplitN(prefix[1:], ")", 2)
+	if len(parts[0]) != len(parts[1]) {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+// Split the membership prefixes (@, +, etc) off a nick from NAMES.
+// With multi-prefix there can be several.
+func (self *ISupport) SplitPrefix(nick string) (prefix, bare string) {
+	_, symbols := self.Prefixes()
+	bare = strings.TrimLeft(nick, symbols)
+	return nick[:len(nick)-len(bare)], bare
+}
+
+// The channel a message target is for. It can start with one STATUSMSG
+// prefix: "@#go-nuts" (to the ops of #go-nuts) is for #go-nuts. If the
+// prefix is also a channel type, as + is on IRCnet, "+chan" is a channel.
+func (self *ISupport) TargetChannel(target string) string {
+	if self.IsChannel(target) {
+		return target
+	}
+	if target != "" && strings.IndexByte(self.tokens["STATUSMSG"], target[0]) != -1 && self.IsChannel(target[1:]) {
+		return target[1:]
+	}
+	return ""
+}
+
+// Casemapping name: rfc1459, strict-rfc1459 or ascii
+func (self *ISupport) CaseMapping() string {
+	return self.tokens["CASEMAPPING"]
+}
+
+// Name of the network, if the server told us
+func (self *ISupport) Network() string {
+	return self.tokens["NETWORK"]
+}
+
+// ISUPPORT values escape some characters as \xHH
+func unescapeISupport(value string) string {
+
+	if !strings.Contains(value, "\\x") {
+		return value
+	}
+
+	var result []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			num, err := strconv.ParseUint(value[i+2:i+4], 16, 8)
+			if err == nil {
+				result = append(result, byte(num))
+				i += 3
+				continue
+			}
+		}
+		result = append(result, value[i])
+	}
+	return string(result)
+}
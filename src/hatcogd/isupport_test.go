@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestISupport(t *testing.T) {
+
+	isupport := NewISupport()
+	isupport.Update([]string{
+		"CHANTYPES=#&!+", "PREFIX=(qaohv)~&@%+", "CASEMAPPING=ascii", "NICKLEN=30",
+		"TARGMAX=PRIVMSG:4,JOIN:", "NETWORK=Example\\x20Net", "STATUSMSG=@+", "EXCEPTS",
+	})
+
+	if !isupport.IsChannel("!12345chan") || !isupport.IsChannel("+modeless") || isupport.IsChannel("bob") {
+		t.Error("Bad channel detection with CHANTYPES", isupport.ChanTypes())
+	}
+	if modes, symbols := isupport.Prefixes(); modes != "qaohv" || symbols != "~&@%+" {
+		t.Error("Bad PREFIX. Got", modes, symbols)
+	}
+	if prefix, nick := isupport.SplitPrefix("@+bob"); prefix != "@+" || nick != "bob" {
+		t.Error("Bad prefix split. Got", prefix, nick)
+	}
+	if isupport.CaseMapping() != "ascii" || isupport.Network() != "Example Net" {
+		t.Error("Bad tokens. Got", isupport.Tokens())
+	}
+	if targMax, _ := isupport.Get("TARGMAX"); targMax != "PRIVMSG:4,JOIN:" {
+		t.Error("Bad TARGMAX. Got", targMax)
+	}
+	if _, ok := isupport.Get("EXCEPTS"); !ok {
+		t.Error("Tokens without a value should be there")
+	}
+
+	isupport.Update([]string{"-EXCEPTS", "-CHANTYPES"})
+	if _, ok := isupport.Get("EXCEPTS"); ok {
+		t.Error("-EXCEPTS should remove it")
+	}
+	if isupport.ChanTypes() != "#&" {
+		t.Error("-CHANTYPES should go back to the default. Got", isupport.ChanTypes())
+	}
+}
+
+func TestParseLine_chanTypes(t *testing.T) {
+
+	line, _ := ParseLine(":bob!b@example.com PRIVMSG &local :hi")
+	if line.Channel != "&local" {
+		t.Error("& is a channel by default. Got", line.Channel)
+	}
+
+	isupport := NewISupport()
+	isupport.Update([]string{"CHANTYPES=#+", "STATUSMSG=@"})
+
+	line, _ = ParseLineWith(":bob!b@example.com PRIVMSG +modeless :hi", isupport)
+	if line.Channel != "+modeless" {
+		t.Error("+ channel from CHANTYPES. Got", line.Channel)
+	}
+
+	line, _ = ParseLineWith(":bob!b@example.com PRIVMSG @#test :ops only", isupport)
+	if line.Channel != "#test" {
+		t.Error("STATUSMSG target is for the channel. Got", line.Channel)
+	}
+
+	line, _ = ParseLineWith(":bob!b@example.com PRIVMSG @@#test :hi", isupport)
+	if line.Channel != "bob" {
+		t.Error("Only one STATUSMSG prefix is allowed, so not a channel. Got", line.Channel)
+	}
+
+	// IRCnet: + is a channel type and a STATUSMSG prefix
+	ircnet := NewISupport()
+	ircnet.Update([]string{"CHANTYPES=#&!+", "STATUSMSG=@+"})
+
+	line, _ = ParseLineWith(":bob!b@example.com PRIVMSG +chan :hi", ircnet)
+	if line.Channel != "+chan" {
+		t.Error("+chan is a channel on IRCnet. Got", line.Channel)
+	}
+	line, _ = ParseLineWith(":bob!b@example.com PRIVMSG @+chan :voiced only", ircnet)
+	if line.Channel != "+chan" {
+		t.Error("@+chan is for the ops of +chan. Got", line.Channel)
+	}
+
+	line, _ = ParseLineWith(":hatcog MODE hatcog +i", isupport)
+	if line.Channel != "" {
+		t.Error("User mode is not a channel. Got", line.Channel)
+	}
+
+	line, _ = ParseLineWith(":bob!b@example.com PRIVMSG hatcog :hi", isupport)
+	if line.Channel != "bob" {
+		t.Error("Private message channel is the sender. Got", line.Channel)
+	}
+}
+
+func TestExternal_isupport(t *testing.T) {
+
+	ext, _ := newTestExternal()
+	serverSays(ext, ":irc.example.com 005 hatcog CHANTYPES=#! NETWORK=Example :are supported by this server")
+
+	if !ext.IsChannel("!abcdefchan") || ext.IsChannel("&local") {
+		t.Error("External should use the server's CHANTYPES")
+	}
+	line, _ := ext.parse(":bob!b@example.com PRIVMSG !abcdefchan :hi")
+	if line.Channel != "!abcdefchan" {
+		t.Error("Parse should use the server's CHANTYPES. Got", line.Channel)
+	}
+	if ext.Status().Support["NETWORK"] != "Example" {
+		t.Error("Status should include ISUPPORT. Got", ext.Status().Support)
+	}
+}
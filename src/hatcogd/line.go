@@ -14,16 +14,22 @@ var (
 )
 
 type Line struct {
-	Network  string
-	Raw      string
-	Received string
-	User     string
-	Host     string
-	Command  string
-	Args     []string
-	Content  string
-	IsCTCP   bool
-	Channel  string
+	Network       string
+	Raw           string
+	Received      string // When the server sent it, if we know, otherwise ReceivedLocal
+	ReceivedLocal string // When we read it
+	Delay         int    // Seconds between Received and ReceivedLocal
+	User          string
+	Host          string
+	Command       string
+	Args          []string
+	Content       string
+	IsCTCP        bool
+	Channel       string
+	Tags          map[string]string // IRCv3 message tags, unescaped
+	IsReplay      bool              // From scrollback, not live
+	Channels      []string          // QUIT and NICK: channels the user was in
+	IsOurNick     bool              // NICK: the server changed our nick
 }
 
 func (self *Line) String() string {
@@ -41,13 +47,43 @@ func (self *Line) AsJson() []byte {
 	return jsonData
 }
 
-// Takes a raw string from IRC server and parses it
+// A line we made up, rather than read from a server
+func NewLine(network, command, content string) *Line {
+	now := time.Now().Format(time.RFC3339)
+	return &Line{
+		Network:       network,
+		Received:      now,
+		ReceivedLocal: now,
+		Command:       command,
+		Content:       content,
+	}
+}
+
+// 'v' as json, with the ending clients expect. For types that embed Line,
+// whose AsJson would leave out their own fields.
+func asJson(v interface{}) []byte {
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error on json Marshal of %T: %v", v, err)
+	}
+	return append(jsonData, '\n')
+}
+
+// Takes a raw string from IRC server and parses it, assuming the server
+// supports the RFC 1459 defaults
 func ParseLine(data string) (*Line, error) {
+	return ParseLineWith(data, nil)
+}
+
+// Takes a raw string from IRC server and parses it. 'isupport' is what the
+// server told us in RPL_ISUPPORT, which says what a channel looks like.
+func ParseLineWith(data string, isupport *ISupport) (*Line, error) {
 
 	var line *Line
 	var prefix, command, trailing, user, host, raw string
 	var args, parts []string
 	var isCTCP bool
+	var tags map[string]string
 
 	data = sane(data)
 
@@ -56,6 +92,19 @@ func ParseLine(data string) (*Line, error) {
 	}
 
 	raw = data
+	if data[0] == '@' { // IRCv3 message tags
+		parts = strings.SplitN(data[1:], " ", 2)
+		if len(parts) != 2 {
+			return nil, ELMALFORMED
+		}
+		tags = parseTags(parts[0])
+		data = strings.TrimLeft(parts[1], " ")
+
+		if len(data) == 0 {
+			return nil, ELSHORT
+		}
+	}
+
 	if data[0] == ':' { // Do we have a prefix?
 		parts = strings.SplitN(data[1:], " ", 2)
 		if len(parts) != 2 {
@@ -101,10 +150,19 @@ func ParseLine(data string) (*Line, error) {
 	command = args[0]
 	args = args[1:len(args)]
 
+	if isupport == nil {
+		isupport = NewISupport()
+	}
+
 	channel := ""
-	for _, arg := range args {
-		if strings.HasPrefix(arg, "#") {
-			channel = arg
+	targets := args
+	if command == "MODE" && len(args) > 1 {
+		// "MODE nick +i" isn't a channel, even if + is in CHANTYPES
+		targets = args[:1]
+	}
+	for _, arg := range targets {
+		channel = isupport.TargetChannel(arg)
+		if channel != "" {
 			break
 		}
 	}
@@ -140,18 +198,113 @@ func ParseLine(data string) (*Line, error) {
 		command = "VERSION"
 	}
 
+	now := time.Now().Format(time.RFC3339)
 	line = &Line{
-		Network:  "", // Set later by External
-		Raw:      raw,
-		Received: time.Now().Format(time.RFC3339),
-		User:     user,
-		Host:     host,
-		Command:  command,
-		Args:     args,
-		Content:  trailing,
-		IsCTCP:   isCTCP,
-		Channel:  channel,
+		Network:       "", // Set later by External
+		Raw:           raw,
+		Received:      now,
+		ReceivedLocal: now,
+		User:          user,
+		Host:          host,
+		Command:       command,
+		Args:          args,
+		Content:       trailing,
+		IsCTCP:        isCTCP,
+		Channel:       channel,
+		Tags:          tags,
 	}
 
 	return line, nil
 }
+
+// Use the time the server sent the line, from the IRCv3 server-time tag,
+// as Received. Only call this if the server-time capability is enabled.
+func (self *Line) useServerTime() {
+
+	serverTime, ok := self.Tags["time"]
+	if !ok {
+		return
+	}
+
+	sent, err := time.Parse(time.RFC3339, serverTime)
+	if err != nil {
+		log.Println("Invalid server-time:", serverTime, err)
+		return
+	}
+
+	local, err := time.Parse(time.RFC3339, self.ReceivedLocal)
+	if err != nil {
+		return
+	}
+
+	self.Received = sent.Local().Format(time.RFC3339)
+	self.Delay = int(local.Sub(sent).Seconds())
+}
+
+// When the server sent the line, or now if Received isn't a valid time
+func (self *Line) ReceivedTime() time.Time {
+	received, err := time.Parse(time.RFC3339, self.Received)
+	if err != nil {
+		return time.Now()
+	}
+	return received
+}
+
+// Split the tags section of a line (without the leading @) into a map.
+// Client-only tags keep their + prefix. See http://ircv3.net/specs/core/message-tags-3.2.html
+func parseTags(data string) map[string]string {
+
+	tags := make(map[string]string)
+
+	for _, tag := range strings.Split(data, ";") {
+		if len(tag) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) == 2 {
+			tags[parts[0]] = unescapeTag(parts[1])
+		} else {
+			tags[parts[0]] = ""
+		}
+	}
+
+	return tags
+}
+
+// Undo the escaping of a message tag value
+func unescapeTag(value string) string {
+
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+
+	var result []byte
+	for i := 0; i < len(value); i++ {
+
+		if value[i] != '\\' {
+			result = append(result, value[i])
+			continue
+		}
+
+		i++
+		if i == len(value) { // Trailing backslash is dropped
+			break
+		}
+
+		switch value[i] {
+		case ':':
+			result = append(result, ';')
+		case 's':
+			result = append(result, ' ')
+		case 'r':
+			result = append(result, '\r')
+		case 'n':
+			result = append(result, '\n')
+		default: // Includes \\
+			result = append(result, value[i])
+		}
+	}
+
+	return string(result)
+}
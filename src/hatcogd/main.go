@@ -16,19 +16,27 @@ const (
 )
 
 var (
-	host   = flag.String("host", "127.0.0.1", "Internal address to bind")
-	port   = flag.String("port", "8790", "Internal port to listen on")
-	logdir = flag.String("logdir", "", "Directory for log files")
+	host       = flag.String("host", "127.0.0.1", "Internal address to bind")
+	port       = flag.String("port", "8790", "Internal port to listen on")
+	logdir     = flag.String("logdir", "", "Directory for log files")
+	certFile   = flag.String("cert", "", "TLS client certificate, for SASL EXTERNAL")
+	keyFile    = flag.String("key", "", "TLS client certificate key, for SASL EXTERNAL")
+	backlog    = flag.Int("backlog", 20, "Lines of scrollback to send a window when it opens")
+	detach     = flag.Bool("detach", false, "Stay in channels when the last window on them closes")
+	listenOn   = flag.String("listen", "tcp", "Listen for clients on: tcp (-host and -port), unix (socket in -logdir), or both")
+	configFile = flag.String("config", "", "Config file with the networks. Default is ~/"+CONFIG_NAME)
+	quitMsg    = flag.String("quit", "hatcog (github.com/grahamking/hatcog)", "QUIT message when we disconnect from a network")
 )
 
 func main() {
 
 	flag.Parse()
 
+	var logfile *os.File
 	if len(*logdir) != 0 {
 		logFilename := *logdir + "/server.log"
 		fmt.Println(VERSION, "logging to", logFilename)
-		logfile := openLogFile(logFilename)
+		logfile = openLogFile(logFilename)
 		log.SetOutput(logfile)
 	} else {
 		fmt.Println(VERSION, "logging to console")
@@ -36,26 +44,48 @@ func main() {
 
 	log.Println("START")
 
-	server := NewServer(*host, *port)
-	defer server.Close()
+	config, err := loadConfig(configPath())
+	if err != nil {
+		fmt.Println("Error reading config file:", err)
+		log.Println("Error reading config file:", err)
+		os.Exit(1)
+	}
+	log.Println("Networks in", configPath(), ":", config.Names())
+
+	server := NewServer(*host, *port, config)
+	err = server.Listen()
+	if err != nil {
+		fmt.Println("Error on internal listen:", err)
+		log.Println("Error on internal listen:", err)
+		os.Exit(1)
+	}
+
 	go server.Run()
 
-	// Wait for stop signal (Ctrl-C, kill) to exit
-	incoming := make(chan os.Signal)
-	signal.Notify(incoming, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
-	for {
-		<-incoming
-		break
-		/*
-		   sig := (<-signal.Incoming).(os.UnixSignal)
-		   if sig == syscall.SIGINT ||
-		       sig == syscall.SIGKILL ||
-		       sig == syscall.SIGTERM {
-		       break
-		   }
-		*/
+	// Reload config on SIGHUP. Wait for stop signal (Ctrl-C, kill) to exit.
+	incoming := make(chan os.Signal, 1)
+	signal.Notify(incoming, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range incoming {
+		if sig != syscall.SIGHUP {
+			log.Println("Got", sig, "shutting down")
+			break
+		}
+		if logfile != nil {
+			// logrotate might have moved it
+			previous := logfile
+			logfile = openLogFile(*logdir + "/server.log")
+			log.SetOutput(logfile)
+			previous.Close()
+		}
+		server.Reload()
 	}
+
+	server.Shutdown(*quitMsg)
+
 	log.Println("END")
+	if logfile != nil {
+		logfile.Sync()
+	}
 }
 
 // Record panic in log file - run this from defer
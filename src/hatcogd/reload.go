@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+)
+
+// Re-read the config file, and make our networks match it. Tells the
+// log and every client what changed.
+func (self *Server) Reload() {
+
+	log.Println("Reloading config from", configPath())
+
+	config, err := loadConfig(configPath())
+	if err != nil {
+		log.Println("Error reading config file, keeping the old one:", err)
+		self.notifyEveryone("Error reloading config: " + err.Error())
+		return
+	}
+
+	changes := self.external.Reload(config)
+	if len(changes) == 0 {
+		changes = []string{"no network changes"}
+	}
+	for _, change := range changes {
+		log.Println("Config reload:", change)
+		self.notifyEveryone("Config reload: " + change)
+	}
+}
+
+// Send a notice to every client, on every network
+func (self *Server) notifyEveryone(msg string) {
+	self.internal.WriteEveryone(NewLine("", "NOTICE", msg).AsJson())
+}
+
+// Use a new config. Networks that were added are connected, ones that were
+// removed are disconnected. If a network's address changed we have to
+// reconnect, otherwise new nicks and passwords are used on the existing
+// connection. Returns a description of each change.
+func (self *ExternalManager) Reload(config *Config) []string {
+
+	self.lock.Lock()
+	old := self.config
+	self.config = config
+	connected := make(map[string]*External)
+	for name, ext := range self.connections {
+		connected[name] = ext
+	}
+	self.lock.Unlock()
+
+	// logrotate might have moved the raw log
+	for _, ext := range connected {
+		ext.reopenRawLog()
+	}
+
+	var changes []string
+
+	for _, name := range old.Names() {
+		if config.Networks[name] == nil {
+			changes = append(changes, "removed "+name)
+			self.Disconnect(name, "")
+		}
+	}
+
+	for _, name := range config.Names() {
+		netConf := config.Networks[name]
+		oldConf := old.Networks[name]
+		ext := connected[name]
+
+		switch {
+
+		case oldConf == nil:
+			changes = append(changes, "added "+name)
+			self.Connect(name)
+
+		case ext == nil:
+			// Not connected, we'll use the new settings when we are
+
+		case netConf.Address != oldConf.Address || netConf.ServerPass != oldConf.ServerPass:
+			changes = append(changes, "reconnecting to "+name+", it's address changed")
+			self.Disconnect(name, "Reconnecting")
+			// The old connection must be gone before we add one with the same name
+			if !ext.Wait(SHUTDOWN_WAIT_NS) {
+				log.Println("Gave up waiting for", name, "to close")
+				ext.Close()
+			}
+			self.Connect(name)
+
+		default:
+			for _, change := range ext.Reconfigure(oldConf, netConf) {
+				changes = append(changes, name+": "+change)
+			}
+		}
+	}
+
+	return changes
+}
+
+// Use new nick, password and real name settings, without reconnecting.
+// Returns what changed.
+func (self *External) Reconfigure(oldConf, netConf *NetworkConfig) []string {
+
+	// Might run a command, so not holding the lock
+	var password string
+	if netConf.Password != oldConf.Password {
+		password = netConf.password()
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var changes []string
+
+	if netConf.Nick != oldConf.Nick || netConf.RealName != oldConf.RealName {
+		// USER only matters when we register, next time we reconnect
+		self.userCmd = netConf.userCmd()
+	}
+	if netConf.RealName != oldConf.RealName {
+		changes = append(changes, "real name is now "+netConf.RealName+", from the next reconnect")
+	}
+
+	if netConf.Nick != oldConf.Nick {
+		changes = append(changes, "nick is now "+netConf.Nick)
+		if self.isRegistered {
+			// We change self.nick when the server says we can
+			self.sendRaw("NICK " + netConf.Nick)
+		} else {
+			self.nick = netConf.Nick
+		}
+	}
+
+	if netConf.Password != oldConf.Password {
+		changes = append(changes, "new password")
+		self.password = password
+		self.isIdentified = false
+		if self.isRegistered {
+			self.identifyNickServ()
+		}
+	}
+
+	return changes
+}
+
+// Write the raw log to a new file, in case the old one was rotated
+func (self *External) reopenRawLog() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	logFile := openLogFile(*logdir + "/server_raw.log")
+	self.rawLog.SetOutput(logFile)
+	if self.rawLogFile != nil {
+		self.rawLogFile.Close()
+	}
+	self.rawLogFile = logFile
+}
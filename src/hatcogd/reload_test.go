@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExternalManager_reload(t *testing.T) {
+
+	defer useTempLogdir(t)()
+
+	moved, movedSent := newTestExternal()
+	moved.network = "moved"
+	go func() {
+		// The server closes after our QUIT, a bit later
+		<-movedSent
+		time.Sleep(50 * time.Millisecond)
+		close(moved.done)
+	}()
+
+	added := newFakeConn()
+	reconnected := newFakeConn()
+	defer func() { dial = sock }()
+	dial = func(address string) (net.Conn, error) {
+		if address == "irc.example.net:6697" {
+			select {
+			case <-moved.done:
+			default:
+				t.Error("Reconnected before the old connection closed")
+			}
+			return reconnected, nil
+		}
+		return added, nil
+	}
+
+	kept, keptSent := newTestExternal()
+	kept.network = "kept"
+	kept.nick = "old_nick"
+	kept.isRegistered = true
+	removed, removedSent := newTestExternal()
+	removed.network = "removed"
+
+	network := func(name, nick, password string) *NetworkConfig {
+		return &NetworkConfig{Name: name, Address: "irc.example.com:6697", Nick: nick, Password: password, RealName: "Hatcog"}
+	}
+	old := NewConfig()
+	old.Networks["kept"] = network("kept", "old_nick", "pw1")
+	old.Networks["removed"] = network("removed", "nick", "")
+	old.Networks["moved"] = network("moved", "nick", "")
+	manager := &ExternalManager{
+		connections: map[string]*External{"kept": kept, "removed": removed, "moved": moved},
+		config:      old,
+		fromServer:  make(chan *Line, 10),
+	}
+	defer manager.Shutdown("", 100*time.Millisecond)
+
+	config := NewConfig()
+	config.Networks["kept"] = network("kept", "new_nick", "$(echo pw2)")
+	config.Networks["added"] = network("added", "nick", "")
+	config.Networks["moved"] = network("moved", "nick", "")
+	config.Networks["moved"].Address = "irc.example.net:6697"
+	changes := manager.Reload(config)
+
+	expected := []string{
+		"removed removed", "added added", "kept: nick is now new_nick", "kept: new password",
+		"reconnecting to moved, it's address changed",
+	}
+	if strings.Join(changes, "|") != strings.Join(expected, "|") {
+		t.Error("Expected changes", expected, "Got", changes)
+	}
+
+	expectSent(t, keptSent, "NICK new_nick")
+	expectSent(t, keptSent, "PRIVMSG NickServ :identify pw2")
+	expectSent(t, removedSent, "QUIT :"+*quitMsg)
+
+	if networks := manager.Networks(); strings.Join(networks, ",") != "added,kept,moved" {
+		t.Error("Expected added, kept and moved networks. Got", networks)
+	}
+	if manager.get("moved") == moved {
+		t.Error("Moved network should have a new connection")
+	}
+	if got := <-added.written; got != "CAP LS 302\n" {
+		t.Error("Added network should connect. Sent", got)
+	}
+	if got := <-reconnected.written; got != "CAP LS 302\n" {
+		t.Error("Moved network should reconnect. Sent", got)
+	}
+}
+
+// SIGHUP starts a new raw log, so logrotate can move the old one
+func TestExternal_reopenRawLog(t *testing.T) {
+
+	defer useTempLogdir(t)()
+
+	ext, _ := newTestExternal()
+	ext.reopenRawLog()
+	os.Rename(*logdir+"/server_raw.log", *logdir+"/server_raw.log.1")
+
+	ext.reopenRawLog()
+	serverSays(ext, "PING :irc.example.com")
+
+	rotated, _ := ioutil.ReadFile(*logdir + "/server_raw.log.1")
+	current, _ := ioutil.ReadFile(*logdir + "/server_raw.log")
+	if len(rotated) != 0 || !strings.Contains(string(current), "PONG") {
+		t.Error("Expected PONG in the new raw log only. Got", string(rotated), "and", string(current))
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Error codes in replies to requests
+	ERR_BAD_REQUEST   = "bad_request"   // No type
+	ERR_UNKNOWN_TYPE  = "unknown_type"  // We don't know that request type
+	ERR_MISSING_FIELD = "missing_field" // A field the type needs is empty
+	ERR_FAILED        = "failed"        // We tried, e.g. no such network, or the send failed
+)
+
+// A structured command from a client, one json object per line. Clients
+// can send these instead of, or mixed with, the text lines.
+//
+//	{"id": "7", "type": "privmsg", "target": "#go-nuts", "text": "Hello"}
+//
+// The daemon replies with OK or ERROR, carrying the same id, once it has
+// done what was asked.
+type Request struct {
+	Id       string   `json:"id"` // Optional, echoed in the reply
+	Type     string   `json:"type"`
+	Network  string   `json:"network"` // Default is the connection's network
+	Target   string   `json:"target"`  // Channel or nick. Default is the connection's channel.
+	Text     string   `json:"text"`
+	Key      string   `json:"key"`
+	Nick     string   `json:"nick"`
+	Password string   `json:"password"`
+	Protocol int      `json:"protocol"`
+	Features []string `json:"features"`
+	Count    int      `json:"count"`
+}
+
+// Daemon's answer to a Request
+type Reply struct {
+	Line
+	Id    string
+	Error string // One of the ERR_ codes, empty if OK
+}
+
+func NewReply(id, errCode, msg string) *Reply {
+	reply := &Reply{
+		Line:  *NewLine("", "OK", msg),
+		Id:    id,
+		Error: errCode,
+	}
+	if errCode != "" {
+		reply.Command = "ERROR"
+	}
+	return reply
+}
+
+// Reply as json, with our fields
+func (self *Reply) AsJson() []byte {
+	return asJson(self)
+}
+
+// Is 'content' a json request, rather than a text line. People can say
+// things that start with {, so only a valid json object is a request.
+func parseRequest(content string) (*Request, bool) {
+
+	if !strings.HasPrefix(content, "{") {
+		return nil, false
+	}
+	var request Request
+	err := json.Unmarshal([]byte(content), &request)
+	if err != nil {
+		return nil, false
+	}
+	return &request, true
+}
+
+// Why the request can't be made into a text line, or "" if it can. A new
+// line or NUL would let a field end our IRC command and start another, and
+// a space in a target would add arguments.
+func (self *Request) invalid() string {
+
+	fields := map[string]string{
+		"type": self.Type, "network": self.Network, "target": self.Target, "text": self.Text,
+		"key": self.Key, "nick": self.Nick, "password": self.Password,
+		"features": strings.Join(self.Features, " "),
+	}
+	for name, value := range fields {
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return name + " must not contain CR, LF or NUL"
+		}
+	}
+
+	for name, value := range map[string]string{"target": self.Target, "nick": self.Nick, "key": self.Key} {
+		if strings.Contains(value, " ") {
+			return name + " must not contain spaces"
+		}
+	}
+	return ""
+}
+
+// The text line that does what the request asks, which is how the rest of
+// the daemon understands it. Returns an ERR_ code and message if we can't.
+func (self *Request) asText() (string, string, string) {
+
+	missing := func(field string) (string, string, string) {
+		return "", ERR_MISSING_FIELD, self.Type + " needs " + field
+	}
+
+	if msg := self.invalid(); msg != "" {
+		return "", ERR_BAD_REQUEST, msg
+	}
+
+	switch self.Type {
+
+	case "":
+		return "", ERR_BAD_REQUEST, "Request needs a type"
+
+	case "hello":
+		if self.Protocol < 1 {
+			return missing("protocol")
+		}
+		parts := append([]string{"/hello", strconv.Itoa(self.Protocol)}, self.Features...)
+		return strings.Join(parts, " "), "", ""
+
+	case "connect":
+		if self.Network == "" {
+			return missing("network")
+		}
+		return "/connect " + self.Network, "", ""
+
+	case "disconnect":
+		return strings.TrimSpace("/disconnect " + self.Text), "", ""
+
+	case "nick":
+		if self.Nick == "" {
+			return missing("nick")
+		}
+		return "/nick " + self.Nick, "", ""
+
+	case "user":
+		if self.Nick == "" {
+			return missing("nick")
+		}
+		return "/user " + self.Nick + " 0 * :" + self.Text, "", ""
+
+	case "identify":
+		if self.Password == "" {
+			return missing("password")
+		}
+		return "/pw " + self.Password, "", ""
+
+	case "join":
+		if self.Target == "" {
+			return missing("target")
+		}
+		if self.Key != "" {
+			return "/join " + self.Target + " " + self.Key, "", ""
+		}
+		return "/join " + self.Target, "", ""
+
+	case "private":
+		if self.Target == "" {
+			return missing("target")
+		}
+		return "/private " + self.Target, "", ""
+
+	case "part":
+		if self.Target == "" {
+			return missing("target")
+		}
+		return "/part " + self.Target + " :" + self.Text, "", ""
+
+	case "leave":
+		return "/leave", "", ""
+
+	case "backlog":
+		if self.Count < 1 {
+			return "/backlog", "", ""
+		}
+		return "/backlog " + strconv.Itoa(self.Count), "", ""
+
+	case "privmsg":
+		if self.Text == "" {
+			return missing("text")
+		}
+		if strings.HasPrefix(self.Text, "/") {
+			// Say it, don't run it
+			return "/" + self.Text, "", ""
+		}
+		return self.Text, "", ""
+
+	case "action":
+		if self.Text == "" {
+			return missing("text")
+		}
+		return "/me " + self.Text, "", ""
+
+	case "notice":
+		if self.Target == "" || self.Text == "" {
+			return missing("target and text")
+		}
+		return "/notice " + self.Target + " :" + self.Text, "", ""
+
+	case "status":
+		return "/hatcog status", "", ""
+
+	case "raw":
+		if self.Text == "" {
+			return missing("text")
+		}
+		return "/" + self.Text, "", ""
+	}
+
+	return "", ERR_UNKNOWN_TYPE, "Unknown request type: " + self.Type
+}
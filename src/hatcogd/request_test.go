@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+
+	if _, ok := parseRequest("hello there"); ok {
+		t.Error("Text line is not a request")
+	}
+	if _, ok := parseRequest("{not json"); ok {
+		t.Error("Invalid json is something someone said")
+	}
+
+	request, ok := parseRequest(`{"id": "7", "type": "join", "target": "#test", "key": "secret"}`)
+	if !ok {
+		t.Fatal("Should parse request")
+	}
+	content, errCode, _ := request.asText()
+	if content != "/join #test secret" || errCode != "" {
+		t.Error("Bad join. Got", content, errCode)
+	}
+
+	checks := map[string]string{
+		`{"type": "privmsg", "text": "/not a command"}`:            "//not a command",
+		`{"type": "action", "text": "waves"}`:                      "/me waves",
+		`{"type": "raw", "text": "MODE #test +i"}`:                 "/MODE #test +i",
+		`{"type": "hello", "protocol": 1, "features": ["replay"]}`: "/hello 1 replay",
+	}
+	for data, expected := range checks {
+		request, _ := parseRequest(data)
+		if content, _, _ := request.asText(); content != expected {
+			t.Error("Expected", expected, "Got", content)
+		}
+	}
+
+	errors := map[string]string{
+		`{"type": "join"}`:    ERR_MISSING_FIELD,
+		`{"type": "dance"}`:   ERR_UNKNOWN_TYPE,
+		`{"target": "#test"}`: ERR_BAD_REQUEST,
+	}
+	for data, expected := range errors {
+		request, _ := parseRequest(data)
+		if _, errCode, _ := request.asText(); errCode != expected {
+			t.Error("Expected", expected, "for", data, "Got", errCode)
+		}
+	}
+}
+
+func TestInternal_request(t *testing.T) {
+
+	fromUser := make(chan Message, 10)
+	manager := NewInternalManager("", "", fromUser)
+	internalConn, conn := newTestInternal(manager, "#test")
+	go internalConn.Run()
+	defer close(conn.input)
+
+	ext, sent := newTestExternal()
+	server := &Server{
+		internal: manager,
+		external: &ExternalManager{connections: map[string]*External{ext.network: ext}, config: NewConfig()},
+	}
+
+	conn.input <- `{"id": "1", "type": "privmsg", "target": "bob", "text": "hi"}` + "\n"
+	msg := <-fromUser
+	if msg.channel != "bob" || msg.content != "hi" || msg.network != "irc.example.com:6697" {
+		t.Error("Request should go to target. Got", msg)
+	}
+	select {
+	case got := <-conn.written:
+		t.Error("Should only reply once the server has acted. Got", got)
+	default:
+	}
+	server.onUser(msg)
+	expectSent(t, sent, "PRIVMSG bob :hi")
+	var reply Reply
+	json.Unmarshal([]byte(<-conn.written), &reply)
+	if reply.Command != "OK" || reply.Id != "1" {
+		t.Error("Expected OK reply. Got", reply)
+	}
+
+	conn.input <- `{"id": "2", "type": "dance"}` + "\n"
+	json.Unmarshal([]byte(<-conn.written), &reply)
+	if reply.Command != "ERROR" || reply.Id != "2" || reply.Error != ERR_UNKNOWN_TYPE {
+		t.Error("Expected typed error. Got", reply)
+	}
+
+	conn.input <- `{"id": "3", "type": "privmsg", "network": "nowhere", "text": "hi"}` + "\n"
+	server.onUser(<-fromUser)
+	json.Unmarshal([]byte(<-conn.written), &reply)
+	if reply.Command != "ERROR" || reply.Id != "3" || reply.Error != ERR_FAILED {
+		t.Error("Unknown network should fail. Got", reply)
+	}
+
+	// Scripts can't smuggle in another IRC command
+	for _, request := range []string{
+		`{"id": "4", "type": "privmsg", "target": "#a", "text": "hi\r\nQUIT :owned"}`,
+		`{"id": "4", "type": "join", "target": "#a\u0000"}`,
+		`{"id": "4", "type": "join", "target": "#a", "key": "k 0"}`,
+		`{"id": "4", "type": "nick", "nick": "bob PRIVMSG"}`,
+	} {
+		conn.input <- request + "\n"
+		json.Unmarshal([]byte(<-conn.written), &reply)
+		if reply.Command != "ERROR" || reply.Error != ERR_BAD_REQUEST {
+			t.Error("Expected bad_request for", request, "Got", reply)
+		}
+	}
+	select {
+	case msg := <-fromUser:
+		t.Error("Bad requests should not reach the server. Got", msg)
+	default:
+	}
+
+	// Text lines still work
+	conn.input <- "{ this is just chat\n"
+	if msg := <-fromUser; msg.content != "{ this is just chat" || msg.channel != "#test" {
+		t.Error("Text line should go to our channel. Got", msg)
+	}
+}
+
+func TestInternal_requestJoinFromScript(t *testing.T) {
+
+	fromUser := make(chan Message, 10)
+	manager := NewInternalManager("", "", fromUser)
+	internalConn, _ := newTestInternal(manager, "")
+
+	internalConn.onRequest(&Request{Id: "1", Type: "join", Target: "#test"})
+	if msg := <-fromUser; msg.content != "/join #test" || msg.request == nil {
+		t.Error("Join should go to the server. Got", msg)
+	}
+	if internalConn.channel != "" {
+		t.Error("Script should not become a window on", internalConn.channel)
+	}
+}
+
+// Requests that would send the server something broken
+func TestInternal_requestNeedsWindow(t *testing.T) {
+
+	fromUser := make(chan Message, 10)
+	manager := NewInternalManager("", "", fromUser)
+	script, scriptConn := newTestInternal(manager, "")
+	window, windowConn := newTestInternal(manager, "#test")
+
+	var reply Reply
+	for _, request := range []*Request{
+		{Id: "1", Type: "privmsg", Text: "hi"},
+		{Id: "2", Type: "action", Text: "waves"},
+	} {
+		script.onRequest(request)
+		json.Unmarshal([]byte(<-scriptConn.written), &reply)
+		if reply.Error != ERR_MISSING_FIELD || reply.Id != request.Id {
+			t.Error("Script without a target should get missing_field. Got", reply)
+		}
+	}
+
+	window.onRequest(&Request{Id: "3", Type: "private", Target: "bob"})
+	json.Unmarshal([]byte(<-windowConn.written), &reply)
+	if reply.Error != ERR_BAD_REQUEST || reply.Id != "3" {
+		t.Error("Window can't become private. Got", reply)
+	}
+	if window.channel != "#test" || window.isPrivate {
+		t.Error("Window should stay on #test. Got", window.channel)
+	}
+
+	window.Special("/private bob")
+	var line Line
+	json.Unmarshal([]byte(<-windowConn.written), &line)
+	if line.Command != "ERROR" {
+		t.Error("Text /private should get an error too. Got", line)
+	}
+
+	select {
+	case msg := <-fromUser:
+		t.Error("Nothing should reach the server. Got", msg)
+	default:
+	}
+
+	// A window can say things without a target
+	window.onRequest(&Request{Id: "4", Type: "action", Text: "waves"})
+	if msg := <-fromUser; msg.channel != "#test" || msg.content != "/me waves" {
+		t.Error("Action should go to our channel. Got", msg)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"strings"
+)
+
+const (
+	// Longest AUTHENTICATE payload, longer data is split
+	SASL_CHUNK_SIZE = 400
+
+	RPL_LOGGEDIN    = "900"
+	RPL_SASLSUCCESS = "903"
+	ERR_SASLFAIL    = "904"
+	ERR_SASLTOOLONG = "905"
+	ERR_SASLABORTED = "906"
+	ERR_SASLALREADY = "907"
+)
+
+// SASL authentication during registration.
+// See http://ircv3.net/specs/extensions/sasl-3.1.html
+//
+// We authenticate with EXTERNAL if we have a TLS client certificate,
+// otherwise with PLAIN if the client sent a password (/pw) before it
+// sent USER. If neither is possible we end capability negotiation and
+// fall back to identifying with NickServ.
+type Sasl struct {
+	mechanism string // Mechanism in progress, "" if none
+	isDone    bool   // Finished, successfully or not
+}
+
+// Can we use mechanism 'mech' on this server?
+func (self *External) saslOffers(mech string) bool {
+	if !self.caps.Has("sasl") {
+		return false
+	}
+	mechs := self.caps.Value("sasl")
+	if mechs == "" { // Pre 3.2 servers don't list mechanisms
+		return true
+	}
+	for _, offered := range strings.Split(mechs, ",") {
+		if strings.EqualFold(offered, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start SASL if we can, otherwise end capability negotiation
+// once the client has sent USER.
+func (self *External) maybeStartSasl() {
+
+	if !self.caps.isNegotiating || !self.caps.lsDone || self.sasl.mechanism != "" {
+		return
+	}
+
+	if !self.sasl.isDone && self.saslOffers("EXTERNAL") && self.isCertPresented() {
+		self.sasl.mechanism = "EXTERNAL"
+	} else if !self.sasl.isDone && self.saslOffers("PLAIN") && self.password != "" {
+		self.sasl.mechanism = "PLAIN"
+	}
+
+	if self.sasl.mechanism != "" {
+		log.Println("SASL", self.sasl.mechanism, "authentication on", self.network)
+		self.sendRaw("AUTHENTICATE " + self.sasl.mechanism)
+
+	} else if !self.caps.Has("sasl") || self.isUserSent {
+		self.endCap()
+	}
+}
+
+// Act on AUTHENTICATE from the server
+func (self *External) onAuthenticate(line *Line) {
+
+	if len(line.Args) == 0 || line.Args[0] != "+" {
+		log.Println("Unexpected AUTHENTICATE challenge:", line.Raw)
+		self.sendRaw("AUTHENTICATE *")
+		return
+	}
+
+	switch self.sasl.mechanism {
+	case "EXTERNAL":
+		// Server uses our certificate, we send no identity
+		self.sendRaw("AUTHENTICATE +")
+
+	case "PLAIN":
+		account := self.nick
+		payload := account + "\x00" + account + "\x00" + self.password
+		self.sendAuthenticate(base64.StdEncoding.EncodeToString([]byte(payload)))
+	}
+}
+
+// Send base64 data in AUTHENTICATE chunks. A final chunk of exactly
+// SASL_CHUNK_SIZE is followed by an empty "+" to mark the end.
+func (self *External) sendAuthenticate(data string) {
+
+	for len(data) >= SASL_CHUNK_SIZE {
+		self.sendRaw("AUTHENTICATE " + data[:SASL_CHUNK_SIZE])
+		data = data[SASL_CHUNK_SIZE:]
+	}
+
+	if len(data) == 0 {
+		data = "+"
+	}
+	self.sendRaw("AUTHENTICATE " + data)
+}
+
+// Act on the SASL result numerics. They are also passed on to the clients.
+func (self *External) onSaslResult(line *Line) {
+
+	if self.sasl.mechanism == "" {
+		return
+	}
+	mechanism := self.sasl.mechanism
+	self.sasl.mechanism = ""
+
+	switch line.Command {
+
+	case RPL_SASLSUCCESS, ERR_SASLALREADY:
+		log.Println("SASL", mechanism, "authentication succeeded on", self.network)
+		self.sasl.isDone = true
+		self.isIdentified = true
+		self.endCap()
+
+	case ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED:
+		log.Println("SASL", mechanism, "authentication failed on", self.network, ":", line.Content)
+		if mechanism == "EXTERNAL" && self.password != "" && self.saslOffers("PLAIN") {
+			// Try the password instead
+			self.sasl.mechanism = "PLAIN"
+			self.sendRaw("AUTHENTICATE PLAIN")
+			return
+		}
+		self.sasl.isDone = true
+		self.endCap()
+	}
+}
+
+// Is 'command' one of the SASL result numerics
+func isSaslResult(command string) bool {
+	switch command {
+	case RPL_SASLSUCCESS, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED, ERR_SASLALREADY:
+		return true
+	}
+	return false
+}
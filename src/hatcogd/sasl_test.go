@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSasl_plain(t *testing.T) {
+
+	ext, sent := newTestExternal()
+	ext.startCap()
+	expectSent(t, sent, "CAP LS 302")
+
+	serverSays(ext, ":irc.example.com CAP * LS * :multi-prefix sasl=PLAIN")
+	serverSays(ext, ":irc.example.com CAP * LS :server-time")
+	expectSent(t, sent, "CAP REQ :sasl multi-prefix server-time")
+
+	serverSays(ext, ":irc.example.com CAP * ACK :sasl multi-prefix server-time")
+
+	ext.doCommand("/NICK bob")
+	expectSent(t, sent, "NICK bob")
+
+	ext.Identify("s3cret")
+	expectSent(t, sent, "AUTHENTICATE PLAIN")
+
+	serverSays(ext, "AUTHENTICATE +")
+	expectSent(t, sent, "AUTHENTICATE Ym9iAGJvYgBzM2NyZXQ=")
+
+	serverSays(ext, ":irc.example.com 903 bob :SASL authentication successful")
+	expectSent(t, sent, "CAP END")
+
+	if !ext.isIdentified {
+		t.Error("SASL success should mark us identified")
+	}
+
+	ext.doCommand("/USER bob 0 * Bob")
+	expectSent(t, sent, "USER bob 0 * Bob")
+
+	serverSays(ext, ":irc.example.com 001 bob :Welcome")
+	select {
+	case got := <-sent:
+		t.Error("Should not identify with NickServ after SASL. Sent", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSasl_externalNeedsTLS(t *testing.T) {
+
+	oldCert, oldKey := *certFile, *keyFile
+	*certFile, *keyFile = "client.pem", "client.key"
+	defer func() { *certFile, *keyFile = oldCert, oldKey }()
+
+	// Socket is a plain text pipe, as if TLS failed and we fell back
+	ext, sent := newTestExternal()
+	ext.password = "s3cret"
+	ext.startCap()
+	expectSent(t, sent, "CAP LS 302")
+
+	serverSays(ext, ":irc.example.com CAP * LS :sasl=PLAIN,EXTERNAL")
+	expectSent(t, sent, "CAP REQ :sasl")
+	serverSays(ext, ":irc.example.com CAP * ACK :sasl")
+	expectSent(t, sent, "AUTHENTICATE PLAIN")
+}
+
+func TestSasl_noPassword(t *testing.T) {
+
+	ext, sent := newTestExternal()
+	ext.startCap()
+	expectSent(t, sent, "CAP LS 302")
+
+	serverSays(ext, ":irc.example.com CAP * LS :sasl")
+	expectSent(t, sent, "CAP REQ :sasl")
+	serverSays(ext, ":irc.example.com CAP * ACK sasl")
+
+	// No /pw before USER, so give up on SASL
+	ext.doCommand("/USER bob 0 * Bob")
+	expectSent(t, sent, "USER bob 0 * Bob")
+	expectSent(t, sent, "CAP END")
+}
+
+func TestSasl_failFallsBackToNickServ(t *testing.T) {
+
+	ext, sent := newTestExternal()
+	ext.startCap()
+	expectSent(t, sent, "CAP LS 302")
+
+	serverSays(ext, ":irc.example.com CAP * LS :sasl")
+	expectSent(t, sent, "CAP REQ :sasl")
+	serverSays(ext, ":irc.example.com CAP * ACK :sasl")
+
+	ext.nick = "bob"
+	ext.Identify("wrong")
+	expectSent(t, sent, "AUTHENTICATE PLAIN")
+	serverSays(ext, "AUTHENTICATE +")
+	<-sent
+	serverSays(ext, ":irc.example.com 904 bob :SASL authentication failed")
+	expectSent(t, sent, "CAP END")
+
+	serverSays(ext, ":irc.example.com 001 bob :Welcome")
+	expectSent(t, sent, "PRIVMSG NickServ :identify wrong")
+}
+
+func TestSasl_chunking(t *testing.T) {
+
+	ext, sent := newTestExternal()
+
+	data := strings.Repeat("a", SASL_CHUNK_SIZE*2)
+	ext.sendAuthenticate(data)
+	expectSent(t, sent, "AUTHENTICATE "+data[:SASL_CHUNK_SIZE])
+	expectSent(t, sent, "AUTHENTICATE "+data[SASL_CHUNK_SIZE:])
+	expectSent(t, sent, "AUTHENTICATE +")
+
+	ext.sendAuthenticate(data + "bb")
+	expectSent(t, sent, "AUTHENTICATE "+data[:SASL_CHUNK_SIZE])
+	expectSent(t, sent, "AUTHENTICATE "+data[SASL_CHUNK_SIZE:])
+	expectSent(t, sent, "AUTHENTICATE bb")
+}
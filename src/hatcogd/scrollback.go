@@ -0,0 +1,88 @@
+package main
+
+const (
+	// Most lines we keep per channel
+	SCROLLBACK_SIZE = 500
+)
+
+var (
+	// Lines worth replaying to a new window
+	SCROLLBACK_CMDS = []string{"PRIVMSG", "ACTION", "NOTICE", "TOPIC", "QUIT", "NICK"}
+)
+
+// Network and channel (or nick, for private chat), as a map key
+type chanKey struct {
+	network string
+	channel string
+}
+
+// Ring buffer of the most recent lines in a channel
+type Scrollback struct {
+	lines []*Line
+	next  int  // Index the next line goes in
+	full  bool // Have we wrapped around
+	total int  // Lines ever added
+}
+
+func NewScrollback(size int) *Scrollback {
+	return &Scrollback{lines: make([]*Line, size)}
+}
+
+// Add a line, replacing the oldest if we're full
+func (self *Scrollback) Add(line *Line) {
+	self.lines[self.next] = line
+	self.next = (self.next + 1) % len(self.lines)
+	if self.next == 0 {
+		self.full = true
+	}
+	self.total++
+}
+
+// Number of lines added since Total returned 'mark'
+func (self *Scrollback) Since(mark int) int {
+	return self.total - mark
+}
+
+// Number of lines ever added, for Since
+func (self *Scrollback) Total() int {
+	return self.total
+}
+
+// Number of lines held
+func (self *Scrollback) Len() int {
+	if self.full {
+		return len(self.lines)
+	}
+	return self.next
+}
+
+// The most recent 'count' lines, oldest first
+func (self *Scrollback) Last(count int) []*Line {
+
+	if count > self.Len() {
+		count = self.Len()
+	}
+	if count <= 0 {
+		return nil
+	}
+
+	result := make([]*Line, 0, count)
+	start := self.next - count
+	if start < 0 {
+		start += len(self.lines)
+	}
+	for i := 0; i < count; i++ {
+		result = append(result, self.lines[(start+i)%len(self.lines)])
+	}
+	return result
+}
+
+// Should lines with 'command' go in the scrollback
+func isScrollbackCommand(command string) bool {
+	for _, cmd := range SCROLLBACK_CMDS {
+		if cmd == command {
+			return true
+		}
+	}
+	return false
+}
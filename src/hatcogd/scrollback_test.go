@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestScrollback(t *testing.T) {
+
+	scrollback := NewScrollback(3)
+	if scrollback.Last(5) != nil {
+		t.Error("Empty scrollback should have no lines")
+	}
+
+	for _, content := range []string{"one", "two"} {
+		scrollback.Add(&Line{Content: content})
+	}
+	lines := scrollback.Last(5)
+	if len(lines) != 2 || lines[0].Content != "one" || lines[1].Content != "two" {
+		t.Error("Last incorrect before wrapping. Got", lines)
+	}
+
+	for _, content := range []string{"three", "four", "five"} {
+		scrollback.Add(&Line{Content: content})
+	}
+	lines = scrollback.Last(2)
+	if len(lines) != 2 || lines[0].Content != "four" || lines[1].Content != "five" {
+		t.Error("Last incorrect after wrapping. Got", lines)
+	}
+	if scrollback.Len() != 3 {
+		t.Error("Scrollback should be capped. Got", scrollback.Len())
+	}
+}
+
+func TestInternal_backlogOnAttach(t *testing.T) {
+
+	manager := NewInternalManager("", "", make(chan Message, 10))
+	network := "irc.example.com:6697"
+	for _, content := range []string{"one", "two", "three"} {
+		line, _ := ParseLine(":alice!a@example.com PRIVMSG #test :" + content)
+		line.Network = network
+		manager.Record(line)
+	}
+	join, _ := ParseLine(":alice!a@example.com JOIN #test")
+	join.Network = network
+	manager.Record(join)
+
+	internalConn, conn := newTestInternal(manager, "")
+	defer func(previous int) { *backlog = previous }(*backlog)
+	*backlog = 2
+	if internalConn.Special("/join #test") {
+		t.Error("/join should still go to the server")
+	}
+
+	for _, expected := range []string{"two", "three"} {
+		var line Line
+		json.Unmarshal([]byte(<-conn.written), &line)
+		if line.Content != expected || !line.IsReplay {
+			t.Error("Expected replay of", expected, "Got", line)
+		}
+	}
+
+	if !internalConn.Special("/backlog 1") {
+		t.Error("/backlog is internal only")
+	}
+	var line Line
+	json.Unmarshal([]byte(<-conn.written), &line)
+	if line.Content != "three" {
+		t.Error("/backlog 1 should send the last line. Got", line)
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"strings"
 )
 
 const (
 	RPL_NAMREPLY = "353"
+
+	// How long shutdown waits for the networks to close after QUIT
+	SHUTDOWN_WAIT_NS = QUIT_WAIT_NS + 2*ONE_SECOND_NS
+
+	STATE_STOPPING = "stopping" // hatcogd is shutting down
 )
 
 var (
@@ -21,7 +27,7 @@ type Server struct {
 	fromUser   chan Message
 }
 
-func NewServer(host, port string) *Server {
+func NewServer(host, port string, config *Config) *Server {
 
 	fromServer := make(chan *Line)
 	fromUser := make(chan Message)
@@ -30,9 +36,7 @@ func NewServer(host, port string) *Server {
 	internal := NewInternalManager(host, port, fromUser)
 
 	// Socket connections to IRC servers
-	external := NewExternalManager(fromServer)
-
-	log.Println("Listening for internal connection on " + host + ":" + port)
+	external := NewExternalManager(fromServer, config)
 
 	return &Server{
 		"",
@@ -61,11 +65,30 @@ func (self *Server) Run() {
 	}
 }
 
+// Start listening for internal connections. Call before Run.
+func (self *Server) Listen() error {
+	return self.internal.Listen()
+}
+
+// Close every client and network connection, without saying goodbye
 func (self *Server) Close() error {
 	self.internal.Close()
 	return self.external.Close()
 }
 
+// Tell the clients we're stopping, QUIT every network, wait up to
+// SHUTDOWN_WAIT_NS for them to close, then close everything.
+// Run must still be going, it passes on the networks' last lines.
+func (self *Server) Shutdown(msg string) {
+
+	stopping := NewLine("", "STATE", "hatcogd is stopping")
+	stopping.Args = []string{STATE_STOPPING}
+	self.internal.WriteFeature("", "state", stopping.AsJson())
+
+	self.external.Shutdown(msg, SHUTDOWN_WAIT_NS)
+	self.Close()
+}
+
 // Act on server messages
 func (self *Server) onServer(line *Line) {
 
@@ -73,13 +96,51 @@ func (self *Server) onServer(line *Line) {
 		log.Println(line.Content)
 	}
 
+	if line.Command == "001" && len(line.Args) > 0 {
+		// Registered, maybe by us with a nick from the config file
+		self.internal.SetNick(line.Network, line.Args[0])
+	}
+
+	if line.Command == RPL_ISUPPORT {
+		// External has the new tokens, we need the casemapping to match channels
+		self.internal.SetCaseMapping(line.Network, self.external.CaseMapping(line.Network))
+	}
+
+	if line.IsOurNick {
+		// Every window shows our nick. Server may change it without us asking.
+		self.internal.SetNick(line.Network, line.Content)
+		self.internal.Record(line)
+		self.internal.WriteAll(line.Network, line.AsJson())
+		return
+	}
+
+	if self.isLeaving(line) {
+		self.internal.Forget(line.Network, line.Channel)
+	}
+
 	isMsg := (line.Command == "PRIVMSG")
-	isPrivate := isMsg && (line.User == line.Channel)
+	isPrivate := isMsg && line.Channel != "" && !self.external.IsChannel(line.Network, line.Channel)
+
+	if isPrivate {
+		if self.internal.QueuePrivate(line) > 0 {
+			// No window for this private chat. Ask a client to open one,
+			// messages wait in the queue until it does.
+			self.internal.PromptPrivate(line.Network, line.Channel)
+			return
+		}
+	}
+
+	self.internal.Record(line)
 
-	if isPrivate && !self.internal.HasChannel(line.Channel) {
-		self.internal.lastPrivate = []byte(line.AsJson())
-		//go self.openPrivate(line.Network, line.User)
-		self.internal.WriteFirst(line.Network, line.AsJson())
+	if feature := FEATURE_COMMANDS[line.Command]; feature != "" {
+		self.internal.WriteFeature(line.Network, feature, line.AsJson())
+
+	} else if line.Command == "QUIT" || line.Command == "NICK" {
+		// Only the windows that know the user
+		for _, channel := range line.Channels {
+			self.internal.WriteChannel(line.Network, channel, line.AsJson())
+		}
+		self.internal.WriteChannel(line.Network, line.User, line.AsJson())
 
 	} else if len(line.Channel) == 0 && !isChannelRequired(line.Command) {
 		self.internal.WriteAll(line.Network, line.AsJson())
@@ -94,6 +155,7 @@ func (self *Server) onServer(line *Line) {
 func (self *Server) onUser(message Message) {
 
 	var cmd, content string
+	var err error
 
 	if isCommand(message.content) {
 
@@ -103,36 +165,134 @@ func (self *Server) onUser(message Message) {
 			content = parts[1]
 		}
 
-		if cmd == "pw" {
-			self.external.Identify(message.network, content)
+		if cmd == "hello" {
+			// Internal.Special checked it, and kept the client's features
+			protocol, _, _ := parseHello(message.content)
+			hello := NewHello(protocol, self.external.Networks(), self.external.Configured())
+			message.from.Write(hello.AsJson())
+
+		} else if cmd == "hatcog" {
+			err = self.onControl(message, content)
+
+		} else if cmd == "pw" {
+			err = self.external.Identify(message.network, content)
 
 		} else if cmd == "me" {
-			self.external.SendAction(message.network, message.channel, content)
+			err = self.external.SendAction(message.network, message.channel, content)
+			self.recordOwn(message, "ACTION", content)
 
 		} else if cmd == "nick" {
 			newNick := content
 			self.nick = newNick
 			self.internal.SetNick(message.network, newNick)
 
-			self.external.doCommand(message.network, message.content)
+			err = self.external.doCommand(message.network, message.content)
+
+		} else if cmd == "disconnect" {
+			// Quit a network, content is the optional QUIT message
+			if !self.external.Disconnect(message.network, content) {
+				err = errors.New("Not connected to " + message.network)
+				if message.request == nil {
+					message.from.writeError(err.Error())
+				}
+			}
+
+		} else if cmd == "join" {
+			err = self.external.doCommand(message.network, message.content)
+			self.sendChannelState(message, content)
 
 		} else if cmd == "connect" {
 			// Connect to a remote IRC server
 			self.external.Connect(content)
 
 		} else {
-			self.external.doCommand(message.network, message.content)
+			err = self.external.doCommand(message.network, message.content)
 		}
 
 	} else {
-		self.external.SendMessage(message.network, message.channel, message.content)
+		content = message.content
+		if strings.HasPrefix(content, "//") {
+			// Escaped, say it as it is
+			content = content[1:]
+		}
+		err = self.external.SendMessage(message.network, message.channel, content)
+		self.recordOwn(message, "PRIVMSG", content)
+	}
+
+	if message.request != nil {
+		self.reply(message, err)
+	}
+}
+
+// Tell a json client we did what it asked, or why we couldn't
+func (self *Server) reply(message Message, err error) {
+	reply := NewReply(message.request.Id, "", message.request.Type)
+	if err != nil {
+		reply = NewReply(message.request.Id, ERR_FAILED, err.Error())
+	}
+	message.from.Write(reply.AsJson())
+}
+
+// Daemon control commands: /hatcog <command>
+func (self *Server) onControl(message Message, command string) error {
+
+	switch command {
+
+	case "status":
+		status := NewStatus(self.external.Status(), self.internal.Status())
+		message.from.Write(status.AsJson())
+		return nil
+	}
+
+	err := errors.New("Unknown command. Try: /hatcog status")
+	if message.request == nil {
+		message.from.writeError(err.Error())
+	}
+	return err
+}
+
+// If we're already in the channels a client is joining, tell it about them.
+// 'content' is the args of the JOIN: "#a,#b keyA,keyB".
+func (self *Server) sendChannelState(message Message, content string) {
+
+	if message.from == nil || !message.from.announced("channel-state") {
+		return
 	}
 
+	fields := strings.Fields(content)
+	if len(fields) == 0 {
+		return
+	}
+	for _, channel := range strings.Split(fields[0], ",") {
+		snapshot := self.external.ChannelSnapshot(message.network, channel)
+		if snapshot != nil {
+			message.from.Write(snapshot.AsJson())
+		}
+	}
+}
+
+// Record what we said, so scrollback has both sides of the conversation
+func (self *Server) recordOwn(message Message, command, content string) {
+	line := NewLine(message.network, command, content)
+	line.User = self.internal.GetNick(message.network)
+	line.Channel = message.channel
+	self.internal.Record(line)
+}
+
+// Is 'line' us leaving a channel
+func (self *Server) isLeaving(line *Line) bool {
+
+	nick := self.internal.GetNick(line.Network)
+	if line.Command == "PART" {
+		return self.internal.IsSameName(line.Network, line.User, nick)
+	}
+	return line.Command == "KICK" && len(line.Args) > 1 &&
+		self.internal.IsSameName(line.Network, line.Args[1], nick)
 }
 
-// Is 'content' an IRC command?
+// Is 'content' an IRC command? "//" starts a message that begins with "/"
 func isCommand(content string) bool {
-	return len(content) > 1 && content[0] == '/'
+	return len(content) > 1 && content[0] == '/' && content[1] != '/'
 }
 
 // Is 'command' an IRC information command?
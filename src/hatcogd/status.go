@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How often we PING the server to measure lag
+	LAG_CHECK_NS = 60 * ONE_SECOND_NS
+
+	// Start of our PING tokens, so we know the PONG is ours
+	LAG_PREFIX = "hatcog-lag-"
+)
+
+// Daemon's reply to "/hatcog status": what we're connected to, and who to
+type Status struct {
+	Line
+	Networks []NetworkStatus
+	Clients  []ClientStatus
+}
+
+// One External
+type NetworkStatus struct {
+	Network      string // Name from the config file, or the address
+	Address      string // host:port we connect to
+	IsTLS        bool
+	IsConnected  bool
+	IsRegistered bool
+	Nick         string
+	Channels     []string
+	Uptime       int               // Seconds since we connected, 0 if not connected
+	Lag          int               // Milliseconds from our last PING to it's PONG, -1 if not measured yet
+	Support      map[string]string // RPL_ISUPPORT tokens
+}
+
+// One Internal
+type ClientStatus struct {
+	Id         int
+	Network    string
+	Channel    string
+	IsPrivate  bool
+	RemoteAddr string
+	Protocol   int
+}
+
+func NewStatus(networks []NetworkStatus, clients []ClientStatus) *Status {
+	return &Status{
+		Line:     *NewLine("", "STATUS", VERSION),
+		Networks: networks,
+		Clients:  clients,
+	}
+}
+
+// Status as json, with our fields
+func (self *Status) AsJson() []byte {
+	return asJson(self)
+}
+
+// Status of every network, sorted by name
+func (self *ExternalManager) Status() []NetworkStatus {
+
+	var statuses []NetworkStatus
+	for _, network := range self.Networks() {
+		if ext := self.get(network); ext != nil {
+			statuses = append(statuses, ext.Status())
+		}
+	}
+	return statuses
+}
+
+func (self *External) Status() NetworkStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	status := NetworkStatus{
+		Network:      self.network,
+		Address:      self.addr,
+		IsConnected:  self.socket != nil,
+		IsRegistered: self.isRegistered,
+		Nick:         self.nick,
+		Lag:          -1,
+		Support:      self.isupport.Tokens(),
+	}
+	if self.socket != nil {
+		_, status.IsTLS = self.socket.(*tls.Conn)
+		status.Uptime = int(time.Since(self.connectedAt).Seconds())
+	}
+	if self.lag != 0 {
+		status.Lag = int(self.lag / time.Millisecond)
+	}
+	for channel := range self.channels {
+		status.Channels = append(status.Channels, channel)
+	}
+	sort.Strings(status.Channels)
+	return status
+}
+
+// Status of every client connection, in the order they connected
+func (self *InternalManager) Status() []ClientStatus {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	var statuses []ClientStatus
+	for _, conn := range self.connections {
+		statuses = append(statuses, ClientStatus{
+			Id:         conn.id,
+			Network:    conn.network,
+			Channel:    conn.channel,
+			IsPrivate:  conn.isPrivate,
+			RemoteAddr: conn.netConn.RemoteAddr().String(),
+			Protocol:   conn.protocol,
+		})
+	}
+	return statuses
+}
+
+// PING the server every LAG_CHECK_NS, so we know our lag. Call with lock held.
+func (self *External) checkLag() {
+
+	if self.socket == nil || !self.isRegistered || time.Since(self.lagSent) < LAG_CHECK_NS {
+		return
+	}
+	self.lagSent = time.Now()
+	self.sendRaw("PING :" + LAG_PREFIX + strconv.FormatInt(self.lagSent.UnixNano(), 10))
+}
+
+// If 'line' is the PONG to our lag PING, record the lag and return true.
+// Call with lock held.
+func (self *External) onLagPong(line *Line) bool {
+
+	if line.Command != "PONG" || !strings.HasPrefix(line.Content, LAG_PREFIX) {
+		return false
+	}
+	sent, err := strconv.ParseInt(line.Content[len(LAG_PREFIX):], 10, 64)
+	if err == nil {
+		self.lag = time.Since(time.Unix(0, sent))
+	}
+	return true
+}
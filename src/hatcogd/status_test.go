@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_status(t *testing.T) {
+
+	manager := NewInternalManager("", "", make(chan Message, 10))
+	ext, _ := newTestExternal()
+	ext.nick = "hatcog"
+	ext.isRegistered = true
+	ext.connectedAt = time.Now().Add(-time.Minute)
+	ext.channels["#test"] = ""
+	server := &Server{
+		internal: manager,
+		external: &ExternalManager{connections: map[string]*External{ext.network: ext}, config: NewConfig()},
+	}
+	internalConn, conn := newTestInternal(manager, "#test")
+	newTestInternal(manager, "bob")
+
+	server.onUser(Message{ext.network, "#test", "/hatcog status", internalConn, nil})
+
+	var status Status
+	json.Unmarshal([]byte(<-conn.written), &status)
+	if status.Command != "STATUS" || len(status.Networks) != 1 || len(status.Clients) != 2 {
+		t.Fatal("Bad status. Got", status)
+	}
+	network := status.Networks[0]
+	if !network.IsConnected || network.IsTLS || network.Nick != "hatcog" ||
+		network.Uptime < 60 || network.Lag != -1 || network.Channels[0] != "#test" {
+		t.Error("Bad network status. Got", network)
+	}
+	if status.Clients[1].Channel != "bob" || status.Clients[1].Network != ext.network {
+		t.Error("Bad client status. Got", status.Clients[1])
+	}
+
+	server.onUser(Message{ext.network, "#test", "/hatcog dance", internalConn, nil})
+	var line Line
+	json.Unmarshal([]byte(<-conn.written), &line)
+	if line.Command != "ERROR" {
+		t.Error("Unknown control command should be an error. Got", line)
+	}
+}
+
+func TestExternal_lag(t *testing.T) {
+
+	ext, sent := newTestExternal()
+	ext.isRegistered = true
+
+	ext.lock.Lock()
+	ext.checkLag()
+	ext.lock.Unlock()
+
+	ping := <-sent
+	if !strings.HasPrefix(ping, "PING :"+LAG_PREFIX) {
+		t.Fatal("Expected lag PING. Got", ping)
+	}
+
+	// Not again until LAG_CHECK_NS
+	ext.lock.Lock()
+	ext.checkLag()
+	ext.lock.Unlock()
+	select {
+	case got := <-sent:
+		t.Error("Should only PING every LAG_CHECK_NS. Got", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	serverSays(ext, ":irc.example.com PONG irc.example.com :"+ping[len("PING :"):])
+	if ext.Status().Lag < 0 {
+		t.Error("Lag should be measured")
+	}
+	if len(ext.fromServer) != 0 {
+		t.Error("Our PONG should not go to clients")
+	}
+}
+
+func TestExternal_lagWhenBusy(t *testing.T) {
+
+	// fakeConn never times out, like a network that always has something to say
+	conn := newFakeConn()
+	ext, _ := newTestExternal()
+	ext.socket = conn
+	ext.isRegistered = true
+	go ext.read()
+	defer close(conn.input)
+
+	conn.input <- ":alice!a@example.com PRIVMSG #test :hi\n"
+	select {
+	case got := <-conn.written:
+		if !strings.HasPrefix(got, "PING :"+LAG_PREFIX) {
+			t.Error("Expected lag PING. Got", got)
+		}
+	case <-time.After(time.Second):
+		t.Error("Should measure lag without read timeouts")
+	}
+}